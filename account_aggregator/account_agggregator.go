@@ -1,16 +1,21 @@
-package main
+package account_aggregator
 
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"sync"
 	"time"
 
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/config"
 	"github.com/arvindram03/asynch-workers/data"
-	"github.com/arvindram03/asynch-workers/rabbitmq"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/pool"
 	"github.com/go-gorp/gorp"
 	"github.com/lib/pq"
-	"github.com/robfig/config"
+	"github.com/streadway/amqp"
 )
 
 /*
@@ -27,111 +32,181 @@ type Account struct {
 }
 
 var (
-	Config *config.Config
-	ENV    string
+	Config   *config.Config
+	ENV      string
+	Settings config.Settings
+
+	// Required lists the options the worker cannot start without.
+	Required = []string{"postgres-url", "exchange", "accq"}
+
+	// dbMap is the connection to Postgres, which a reload changing
+	// postgres-url swaps.
+	dbLock sync.RWMutex
+	dbMap  *gorp.DbMap
 )
 
 const (
 	PG_UNIQUE_VIOLATION_ERR = "unique_violation"
+	// Data exceptions and integrity violations fail again on every retry.
+	PG_DATA_EXCEPTION_CLASS      = "22"
+	PG_INTEGRITY_VIOLATION_CLASS = "23"
 )
 
-func loadConfig() (err error) {
-	Config, err = config.ReadDefault("../app.conf")
-	if err != nil {
-		log.Fatalf("Failed to read configs. ERR: %+v", err)
-	}
-	return err
+func setConfig(conf *config.Config) {
+	Config = conf
+	ENV = conf.Env
+	Settings = conf.Settings()
 }
 
-func setENV() {
-	ENV = "DEV"
+func initDb() *gorp.DbMap {
+	dbMap, err := openDb(Settings.PostgresURL)
+	if err != nil {
+		logger.Fatalf("Failed to get postgres connection. ERR: %s", config.Redact(err.Error()))
+	}
+	return dbMap
 }
 
-func initDb() *gorp.DbMap {
-	postgresUrl, _ := Config.String(ENV, "postgres-url")
+func openDb(postgresUrl string) (*gorp.DbMap, error) {
 	db, err := sql.Open("postgres", postgresUrl)
 	if err != nil {
-		log.Fatalf("Failed to get postgres connection. ERR: %+v", err)
+		return nil, err
 	}
 
 	dbMap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
 	dbMap.AddTableWithName(Account{}, "accounts").SetKeys(true, "Id")
 
+	return dbMap, nil
+}
+
+func currentDb() *gorp.DbMap {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
 	return dbMap
 }
 
+// redialDb swaps in a connection to postgresUrl once it answers, and closes
+// the previous one, which lets the queries running on it finish.
+func redialDb(postgresUrl string) error {
+	next, err := openDb(postgresUrl)
+	if err != nil {
+		return err
+	}
+	if err := next.Db.Ping(); err != nil {
+		next.Db.Close()
+		return err
+	}
+	dbLock.Lock()
+	previous := dbMap
+	dbMap = next
+	dbLock.Unlock()
+	return previous.Db.Close()
+}
+
 func process(metric data.Metric, dbMap *gorp.DbMap) error {
-	log.Printf("Metric %+v", metric)
 	now := time.Now().UTC()
 	account := Account{Name: metric.Username, Time: now}
 
 	err := dbMap.Insert(&account)
-	if err, ok := err.(*pq.Error); ok &&
-		err.Code.Name() != PG_UNIQUE_VIOLATION_ERR {
-		log.Fatalf("Error inserting account. ERR: %+v", err)
+	if err, ok := err.(*pq.Error); ok {
+		if err.Code.Name() == PG_UNIQUE_VIOLATION_ERR {
+			return nil
+		}
+		switch err.Code.Class() {
+		case PG_DATA_EXCEPTION_CLASS, PG_INTEGRITY_VIOLATION_CLASS:
+			return fault.Permanent(err)
+		}
 	}
+	return fault.Retryable(err)
+}
 
-	return nil
+// watchConfig resizes the handler pool and redials Postgres on reload; every
+// other change needs a restart.
+func watchConfig(handlers *pool.Pool) {
+	reloader := config.NewReloader(Config, "account-handlers", "postgres-url")
+	reloader.Validate = func(next *config.Config) error {
+		return next.AtLeast(1, "account-handlers")
+	}
+	reloader.Apply = func(next *config.Config, changed []string) {
+		if len(config.Changed(changed, "account-handlers")) > 0 {
+			size, _ := next.Int(ENV, "account-handlers")
+			if err := handlers.Resize(size); err != nil {
+				logger.Errorf("Failed to resize handlers. ERR: %+v", err)
+			}
+		}
+		if len(config.Changed(changed, "postgres-url")) > 0 {
+			if err := redialDb(next.Settings().PostgresURL); err != nil {
+				logger.Errorf("Failed to redial postgres, keeping the current connection. ERR: %s", config.Redact(err.Error()))
+			}
+		}
+	}
+	reloader.Start(Config)
 }
 
-func main() {
-	setENV()
-	loadConfig()
-	dbMap := initDb()
-	defer dbMap.Db.Close()
+// Run creates an account for every new username until the process exits.
+func Run(conf *config.Config, b broker.Broker) {
+	setConfig(conf)
+	dbLock.Lock()
+	dbMap = initDb()
+	dbLock.Unlock()
+	defer func() { currentDb().Db.Close() }()
 
-	rabbitmqUrl, _ := Config.String(ENV, "rabbitmq-url")
-	conn, err := rabbitmq.Dial(rabbitmqUrl)
-	if err != nil {
-		log.Fatalf("Failed to get connection. ERR: %+v", err)
-	}
-	defer conn.Close()
+	store := circuit.Configured(Config, "postgres", func() error { return currentDb().Db.Ping() })
 
-	ch, err := rabbitmq.Channel(conn)
-	if err != nil {
-		log.Fatalf("Failed to open channel. ERR: %+v", err)
+	size, _ := Config.Int(ENV, "account-handlers")
+	var key func(amqp.Delivery) string
+	if Settings.OrderByUsername {
+		key = func(d amqp.Delivery) string { return data.Username(d.Body) }
 	}
-	defer ch.Close()
-	exchange, _ := Config.String(ENV, "exchange")
-	err = rabbitmq.Exchange(exchange, ch)
-	if err != nil {
-		log.Fatalf("Failed to declare an exchange. ERR: %+v", err)
+	handlers := pool.New(size, key)
+	pool.Register(Settings.AccQ, handlers)
+	if adaptive := Config.Adaptive(); adaptive.On {
+		handlers.Adapt(adaptive, b, Settings.AccQ)
 	}
+	watchConfig(handlers)
 
-	accq, _ := Config.String(ENV, "accq")
-	q, err := rabbitmq.Queue(accq, ch)
-	if err != nil {
-		log.Fatalf("Failed to declare a queue. ERR: %+v", err)
-	}
+	forever := make(chan bool)
 
-	err = rabbitmq.QueueBind(q, exchange, ch)
+	deadLetter, _ := Config.String(ENV, "dead-letter-exchange")
+	settler, err := fault.NewSettler(b, Settings.AccQ, deadLetter)
 	if err != nil {
-		log.Fatalf("Failed to bind. ERR: %+v", err)
+		logger.Fatalf("Failed to declare the dead letters of %s. ERR: %s", Settings.AccQ, config.Redact(err.Error()))
 	}
+	handle := func(d amqp.Delivery) {
+		var metric data.Metric
+		if err := json.Unmarshal(d.Body, &metric); err != nil {
+			settler.Settle(d, fault.Poison(err))
+			return
+		}
+		if !store.Allow() {
+			settler.Settle(d, circuit.ErrOpen)
+			return
+		}
 
-	msgs, err := rabbitmq.Consume(q, ch)
-	if err != nil {
-		log.Fatalf("Failed to register name collector. ERR: %+v", err)
+		logger.ForDelivery(Settings.AccQ, d).With(logger.MetricFields(metric.Username, metric.Metric, metric.Count)).Infof("Metric")
+		err := process(metric, currentDb())
+		if store.Record(err) {
+			logger.Warnf("Pausing %s", Settings.AccQ)
+			b.Cancel(Settings.AccQ)
+		}
+		settler.Settle(d, err)
 	}
 
-	forever := make(chan bool)
-
+	// Consumption stops while Postgres is down and resumes once the breaker
+	// closes.
 	go func() {
-		for d := range msgs {
-			var metric data.Metric
-			err := json.Unmarshal(d.Body, &metric)
-			if err != nil {
-				log.Fatalf("Error unmarshalling metric. ERR: %+v", err)
-			}
-
-			err = process(metric, dbMap)
+		for {
+			msgs, err := b.Consume(Settings.Exchange, Settings.AccQ, Settings.AccQBindings)
 			if err != nil {
-				d.Nack(true, true)
+				logger.Errorf("Failed to register name collector. ERR: %s", config.Redact(err.Error()))
+				time.Sleep(time.Second)
+				continue
 			}
-			d.Ack(false)
+			handlers.Run(msgs, handle)
+			store.Wait()
+			logger.Infof("Resuming %s", Settings.AccQ)
 		}
 	}()
 
-	log.Printf("Waiting for metrics....")
+	logger.Infof("Waiting for metrics....")
 	<-forever
 }
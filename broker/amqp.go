@@ -0,0 +1,294 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/arvindram03/asynch-workers/rabbitmq"
+	"github.com/streadway/amqp"
+)
+
+// AMQP is a Broker backed by RabbitMQ. The URL is read on every dial so a
+// rotated secret or a reloaded config is picked up.
+type AMQP struct {
+	URL  func() (string, error)
+	Kind string
+	// Prefetch caps the unacked deliveries of each consumer, 0 leaves them
+	// unlimited. Every consumer has a channel of its own, so the cap is set
+	// on the channel and SetPrefetch takes effect immediately.
+	Prefetch int
+
+	mu        sync.Mutex
+	consumers map[string][]amqpConsumer
+	// cancelled are the consumers Cancel stopped. Their channels stay open
+	// so the deliveries in flight can still be settled, and the next
+	// Consume of the queue reuses them.
+	cancelled map[string][]amqpConsumer
+	// redialed are the consumers Redial stopped. Their connections close on
+	// the next Consume of the queue, by when the consumer has settled what
+	// they delivered.
+	redialed map[string][]amqpConsumer
+	tags     int
+}
+
+type amqpConsumer struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	tag  string
+}
+
+func NewAMQP(url func() (string, error), kind string) *AMQP {
+	if kind == "" {
+		kind = FANOUT
+	}
+	return &AMQP{
+		URL:       url,
+		Kind:      kind,
+		consumers: map[string][]amqpConsumer{},
+		cancelled: map[string][]amqpConsumer{},
+		redialed:  map[string][]amqpConsumer{},
+	}
+}
+
+func (b *AMQP) dial() (*amqp.Connection, *amqp.Channel, error) {
+	url, err := b.URL()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := rabbitmq.Dial(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting connection: %v", err)
+	}
+	ch, err := rabbitmq.Channel(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("opening channel: %v", err)
+	}
+	return conn, ch, nil
+}
+
+// Publish opens a connection per message, as the server always did.
+func (b *AMQP) Publish(exchange string, key string, body []byte, correlationID string) error {
+	conn, ch, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("enabling confirms: %v", err)
+	}
+	ack, nack := rabbitmq.GetAckNack(ch)
+	if err := b.declareExchange(ch, exchange); err != nil {
+		return err
+	}
+	if err := rabbitmq.PublishJsonCorrelated(body, exchange, key, correlationID, ch); err != nil {
+		return fmt.Errorf("publishing: %v", err)
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-nack:
+		return ErrNacked
+	}
+}
+
+func (b *AMQP) Declare(exchange string, queue string, patterns []string) error {
+	conn, ch, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer ch.Close()
+	_, err = b.declare(ch, exchange, queue, patterns)
+	return err
+}
+
+func (b *AMQP) Consume(exchange string, queue string, patterns []string) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	closeAll(b.redialed[queue])
+	delete(b.redialed, queue)
+	b.tags++
+	tag := fmt.Sprintf("%s.%d", queue, b.tags)
+	var c amqpConsumer
+	reuse := len(b.cancelled[queue]) > 0
+	if reuse {
+		cancelled := b.cancelled[queue]
+		c = cancelled[len(cancelled)-1]
+		b.cancelled[queue] = cancelled[:len(cancelled)-1]
+	}
+	b.mu.Unlock()
+
+	if reuse {
+		if msgs, err := b.consume(c.ch, exchange, queue, patterns, tag); err == nil {
+			b.add(queue, amqpConsumer{conn: c.conn, ch: c.ch, tag: tag})
+			return msgs, nil
+		}
+		c.conn.Close()
+	}
+
+	conn, ch, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := b.consume(ch, exchange, queue, patterns, tag)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.add(queue, amqpConsumer{conn: conn, ch: ch, tag: tag})
+	return msgs, nil
+}
+
+func (b *AMQP) add(queue string, c amqpConsumer) {
+	b.mu.Lock()
+	b.consumers[queue] = append(b.consumers[queue], c)
+	b.mu.Unlock()
+}
+
+// Depth inspects the queue on a connection of its own.
+func (b *AMQP) Depth(queue string) (int, error) {
+	conn, ch, err := b.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer ch.Close()
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return 0, fmt.Errorf("inspecting queue %s: %v", queue, err)
+	}
+	return q.Messages, nil
+}
+
+// SetPrefetch re-caps the channels consuming queue, including deliveries
+// already flowing to them, a prefetch of 0 lifts the cap.
+func (b *AMQP) SetPrefetch(queue string, prefetch int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.consumers[queue] {
+		if err := rabbitmq.Qos(prefetch, c.ch); err != nil {
+			return fmt.Errorf("setting prefetch of %s: %v", queue, err)
+		}
+	}
+	return nil
+}
+
+// declareExchange explains the refusal to redeclare an exchange of another
+// kind, which is what switching exchange-type on an existing one runs into.
+func (b *AMQP) declareExchange(ch *amqp.Channel, exchange string) error {
+	err := rabbitmq.ExchangeOfKind(exchange, b.Kind, ch)
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("exchange %s exists with a kind other than %s; set a new exchange name or delete the exchange first: %v", exchange, b.Kind, err)
+	}
+	if err != nil {
+		return fmt.Errorf("declaring exchange %s: %v", exchange, err)
+	}
+	return nil
+}
+
+func (b *AMQP) declare(ch *amqp.Channel, exchange string, queue string, patterns []string) (*amqp.Queue, error) {
+	if err := b.declareExchange(ch, exchange); err != nil {
+		return nil, err
+	}
+	q, err := rabbitmq.Queue(queue, ch)
+	if err != nil {
+		return nil, fmt.Errorf("declaring queue %s: %v", queue, err)
+	}
+	keys := []string{""}
+	if b.Kind == TOPIC {
+		keys = patterns
+		if len(keys) == 0 {
+			keys = []string{"#"}
+		}
+	}
+	for _, key := range keys {
+		if err := rabbitmq.QueueBindKey(q, key, exchange, ch); err != nil {
+			return nil, fmt.Errorf("binding %s to %s: %v", queue, exchange, err)
+		}
+	}
+	return q, nil
+}
+
+func (b *AMQP) consume(ch *amqp.Channel, exchange string, queue string, patterns []string, tag string) (<-chan amqp.Delivery, error) {
+	q, err := b.declare(ch, exchange, queue, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if b.Prefetch > 0 {
+		if err := rabbitmq.Qos(b.Prefetch, ch); err != nil {
+			return nil, fmt.Errorf("setting prefetch of %s: %v", queue, err)
+		}
+	}
+	msgs, err := rabbitmq.Consume(q, tag, ch)
+	if err != nil {
+		return nil, fmt.Errorf("consuming %s: %v", queue, err)
+	}
+	return msgs, nil
+}
+
+// Cancel stops the consumers of queue, which closes their deliveries. Their
+// channels stay open until Close, so what they delivered can still be acked
+// or nacked; RabbitMQ requeues whatever is unacked when they close.
+func (b *AMQP) Cancel(queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var first error
+	for _, c := range b.consumers[queue] {
+		if err := c.ch.Cancel(c.tag, false); err != nil && first == nil {
+			first = err
+		}
+	}
+	b.cancelled[queue] = append(b.cancelled[queue], b.consumers[queue]...)
+	delete(b.consumers, queue)
+	return first
+}
+
+// Redial stops every consumer like Cancel, and has the next Consume of their
+// queues dial a new connection instead of reusing theirs, so that a rotated
+// URL takes effect.
+func (b *AMQP) Redial() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var first error
+	for queue, consumers := range b.consumers {
+		for _, c := range consumers {
+			if err := c.ch.Cancel(c.tag, false); err != nil && first == nil {
+				first = err
+			}
+		}
+		b.redialed[queue] = append(b.redialed[queue], consumers...)
+		delete(b.consumers, queue)
+	}
+	for queue, cancelled := range b.cancelled {
+		b.redialed[queue] = append(b.redialed[queue], cancelled...)
+		delete(b.cancelled, queue)
+	}
+	return first
+}
+
+func (b *AMQP) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var first error
+	for _, consumers := range []map[string][]amqpConsumer{b.consumers, b.cancelled, b.redialed} {
+		for queue, c := range consumers {
+			if err := closeAll(c); err != nil && first == nil {
+				first = err
+			}
+			delete(consumers, queue)
+		}
+	}
+	return first
+}
+
+func closeAll(consumers []amqpConsumer) error {
+	var first error
+	for _, c := range consumers {
+		if err := c.conn.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
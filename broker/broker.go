@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrNacked = errors.New("broker nacked the message")
+
+const (
+	RABBITMQ = "rabbitmq"
+	REDIS    = "redis"
+)
+
+// Broker carries metrics from the server to the workers. Its exchanges are
+// of one kind: a FANOUT copies each message into every bound queue, a TOPIC
+// only into the queues with a binding pattern matching the routing key.
+type Broker interface {
+	// Declare creates the exchange and a durable queue bound to it with
+	// patterns, so that the queue keeps what is published before anyone
+	// consumes it. No patterns binds the queue to every key.
+	Declare(exchange string, queue string, patterns []string) error
+
+	// Publish returns once the broker has confirmed the message, or
+	// ErrNacked when it refused it. The deliveries of the message carry
+	// correlationID as their CorrelationId.
+	Publish(exchange string, key string, body []byte, correlationID string) error
+
+	// Consume declares the queue like Declare and delivers its messages
+	// until Close. Every delivery must be acked or nacked; unacked ones are
+	// redelivered after Close.
+	Consume(exchange string, queue string, patterns []string) (<-chan amqp.Delivery, error)
+
+	// Cancel stops this broker's consumers of queue and closes their
+	// deliveries.
+	Cancel(queue string) error
+
+	// Depth is the number of messages waiting in queue, not counting the
+	// delivered ones that are not acked yet.
+	Depth(queue string) (int, error)
+
+	// SetPrefetch changes how many unacked deliveries this broker's
+	// consumers of queue may hold, 0 for unlimited.
+	SetPrefetch(queue string, prefetch int) error
+
+	Close() error
+}
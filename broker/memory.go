@@ -0,0 +1,320 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrClosed = errors.New("broker is closed")
+
+// Memory is an in-process Broker for running the whole pipeline without
+// RabbitMQ. Like an exchange of its Kind it copies every message into each
+// queue bound to the key. Queues keep their messages while no consumer is
+// attached, consumers of the same queue share its messages, and nacked or
+// unacked deliveries are put back at the head of the queue marked as
+// redelivered.
+type Memory struct {
+	Kind string
+	// Prefetch caps the unacked deliveries of each consumer, 0 leaves them
+	// unlimited.
+	Prefetch int
+
+	mu        sync.Mutex
+	ready     *sync.Cond
+	bindings  map[string][]*memoryBinding
+	queues    map[string]*memoryQueue
+	consumers []*memoryConsumer
+	closed    bool
+}
+
+type memoryQueue struct {
+	name     string
+	messages []amqp.Delivery
+}
+
+type memoryBinding struct {
+	queue    *memoryQueue
+	patterns []string
+}
+
+// memoryConsumer plays the part of a channel: it numbers its deliveries and
+// acknowledges them.
+type memoryConsumer struct {
+	broker     *Memory
+	queue      *memoryQueue
+	deliveries chan amqp.Delivery
+	stop       chan bool
+	stopped    bool
+	prefetch   int
+	tag        uint64
+	unacked    map[uint64]amqp.Delivery
+}
+
+func NewMemory(kind string) *Memory {
+	if kind == "" {
+		kind = FANOUT
+	}
+	b := &Memory{
+		Kind:     kind,
+		bindings: map[string][]*memoryBinding{},
+		queues:   map[string]*memoryQueue{},
+	}
+	b.ready = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *Memory) Declare(exchange string, queue string, patterns []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.declare(exchange, queue, patterns)
+	return nil
+}
+
+// declare adds patterns to the queue's binding; like RabbitMQ's, bindings
+// are only ever added.
+func (b *Memory) declare(exchange string, queue string, patterns []string) *memoryQueue {
+	q, ok := b.queues[queue]
+	if !ok {
+		q = &memoryQueue{name: queue}
+		b.queues[queue] = q
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+	for _, binding := range b.bindings[exchange] {
+		if binding.queue == q {
+			binding.patterns = appendMissing(binding.patterns, patterns)
+			return q
+		}
+	}
+	b.bindings[exchange] = append(b.bindings[exchange], &memoryBinding{queue: q, patterns: patterns})
+	return q
+}
+
+func appendMissing(list []string, items []string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			found = found || existing == item
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (b *Memory) Publish(exchange string, key string, body []byte, correlationID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, binding := range b.bindings[exchange] {
+		if !routes(b.Kind, binding.patterns, key) {
+			continue
+		}
+		content := make([]byte, len(body))
+		copy(content, body)
+		q := binding.queue
+		q.messages = append(q.messages, amqp.Delivery{
+			ContentType:   "application/json",
+			CorrelationId: correlationID,
+			Exchange:      exchange,
+			RoutingKey:    key,
+			Body:          content,
+		})
+	}
+	b.ready.Broadcast()
+	return nil
+}
+
+func (b *Memory) Consume(exchange string, queue string, patterns []string) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	c := &memoryConsumer{
+		broker:     b,
+		queue:      b.declare(exchange, queue, patterns),
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan bool),
+		prefetch:   b.Prefetch,
+		unacked:    map[uint64]amqp.Delivery{},
+	}
+	b.consumers = append(b.consumers, c)
+	go c.loop()
+	return c.deliveries, nil
+}
+
+// Cancel stops the consumers of queue, closing their deliveries, and
+// requeues what they had not acked.
+func (b *Memory) Cancel(queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancel(func(c *memoryConsumer) bool { return c.queue.name == queue })
+	return nil
+}
+
+func (b *Memory) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.cancel(func(c *memoryConsumer) bool { return true })
+	return nil
+}
+
+func (b *Memory) cancel(match func(*memoryConsumer) bool) {
+	var kept []*memoryConsumer
+	for _, c := range b.consumers {
+		if !match(c) {
+			kept = append(kept, c)
+			continue
+		}
+		c.stopped = true
+		close(c.stop)
+		c.requeue(c.tags(0, true), true)
+	}
+	b.consumers = kept
+	b.ready.Broadcast()
+}
+
+// Pending reports how many messages wait in the queue, not counting the
+// delivered but unacked ones.
+func (b *Memory) Pending(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+func (b *Memory) Depth(queue string) (int, error) {
+	return b.Pending(queue), nil
+}
+
+func (b *Memory) SetPrefetch(queue string, prefetch int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.consumers {
+		if c.queue.name == queue {
+			c.prefetch = prefetch
+		}
+	}
+	b.ready.Broadcast()
+	return nil
+}
+
+func (c *memoryConsumer) loop() {
+	defer close(c.deliveries)
+	b := c.broker
+	for {
+		b.mu.Lock()
+		for (len(c.queue.messages) == 0 || c.full()) && !c.stopped {
+			b.ready.Wait()
+		}
+		if c.stopped {
+			b.mu.Unlock()
+			return
+		}
+		d := c.queue.messages[0]
+		c.queue.messages = c.queue.messages[1:]
+		c.tag++
+		d.Acknowledger = c
+		d.DeliveryTag = c.tag
+		d.ConsumerTag = c.queue.name
+		c.unacked[d.DeliveryTag] = d
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-c.stop:
+			// Close has requeued d with the rest of the unacked.
+			return
+		}
+	}
+}
+
+func (c *memoryConsumer) full() bool {
+	return c.prefetch > 0 && len(c.unacked) >= c.prefetch
+}
+
+// tags lists the unacked tags that an ack of tag covers, in order.
+func (c *memoryConsumer) tags(tag uint64, multiple bool) []uint64 {
+	var tags []uint64
+	for t := range c.unacked {
+		if t == tag || (multiple && (tag == 0 || t <= tag)) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Sort(uint64s(tags))
+	return tags
+}
+
+func (c *memoryConsumer) requeue(tags []uint64, requeue bool) {
+	redelivered := make([]amqp.Delivery, 0, len(tags))
+	for _, t := range tags {
+		d := c.unacked[t]
+		delete(c.unacked, t)
+		redelivered = append(redelivered, amqp.Delivery{
+			ContentType:   d.ContentType,
+			CorrelationId: d.CorrelationId,
+			Exchange:      d.Exchange,
+			RoutingKey:    d.RoutingKey,
+			Body:          d.Body,
+			Redelivered:   true,
+		})
+	}
+	if requeue && len(redelivered) > 0 {
+		c.queue.messages = append(redelivered, c.queue.messages...)
+		c.broker.ready.Broadcast()
+	}
+}
+
+func (c *memoryConsumer) Ack(tag uint64, multiple bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	tags := c.tags(tag, multiple)
+	if len(tags) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	for _, t := range tags {
+		delete(c.unacked, t)
+	}
+	c.broker.ready.Broadcast()
+	return nil
+}
+
+func (c *memoryConsumer) Nack(tag uint64, multiple bool, requeue bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	tags := c.tags(tag, multiple)
+	if len(tags) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	c.requeue(tags, requeue)
+	c.broker.ready.Broadcast()
+	return nil
+}
+
+func (c *memoryConsumer) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
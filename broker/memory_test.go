@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery within a second")
+	}
+	return amqp.Delivery{}
+}
+
+func expectNone(t *testing.T, msgs <-chan amqp.Delivery) {
+	select {
+	case d, ok := <-msgs:
+		if ok {
+			t.Fatalf("unexpected delivery %q", d.Body)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	cases := []struct {
+		kind     string
+		bindings map[string][]string
+		key      string
+		want     map[string]int
+	}{
+		{FANOUT, map[string][]string{"a": {"metric.login"}, "b": nil}, "metric.logout", map[string]int{"a": 1, "b": 1}},
+		{TOPIC, map[string][]string{"a": {"metric.login"}, "b": nil}, "metric.logout", map[string]int{"a": 0, "b": 1}},
+		{TOPIC, map[string][]string{"a": {"metric.*"}, "b": {"metric.login.#"}}, "metric.login", map[string]int{"a": 1, "b": 1}},
+	}
+	for _, c := range cases {
+		b := NewMemory(c.kind)
+		for queue, patterns := range c.bindings {
+			if err := b.Declare("ex", queue, patterns); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Publish("ex", c.key, []byte("{}"), ""); err != nil {
+			t.Fatal(err)
+		}
+		for queue, want := range c.want {
+			if got := b.Pending(queue); got != want {
+				t.Errorf("%s exchange, %q to %s %v: %d pending, want %d", c.kind, c.key, queue, c.bindings[queue], got, want)
+			}
+		}
+	}
+}
+
+func TestMemoryAckNack(t *testing.T) {
+	cases := []struct {
+		name        string
+		settle      func(d amqp.Delivery) error
+		redelivered bool
+	}{
+		{"ack", func(d amqp.Delivery) error { return d.Ack(false) }, false},
+		{"nack and requeue", func(d amqp.Delivery) error { return d.Nack(false, true) }, true},
+		{"nack", func(d amqp.Delivery) error { return d.Nack(false, false) }, false},
+		{"reject and requeue", func(d amqp.Delivery) error { return d.Reject(true) }, true},
+	}
+	for _, c := range cases {
+		b := NewMemory(FANOUT)
+		msgs, err := b.Consume("ex", "q", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Publish("ex", "", []byte("first"), "req-1")
+		d := receive(t, msgs)
+		if string(d.Body) != "first" || d.CorrelationId != "req-1" || d.Redelivered {
+			t.Fatalf("%s: got %q %q redelivered %v", c.name, d.Body, d.CorrelationId, d.Redelivered)
+		}
+		if err := c.settle(d); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !c.redelivered {
+			expectNone(t, msgs)
+			b.Close()
+			continue
+		}
+		d = receive(t, msgs)
+		if string(d.Body) != "first" || d.CorrelationId != "req-1" || !d.Redelivered {
+			t.Errorf("%s: got %q %q redelivered %v, want the first message redelivered", c.name, d.Body, d.CorrelationId, d.Redelivered)
+		}
+		b.Close()
+	}
+}
+
+func TestMemoryAckUnknownTag(t *testing.T) {
+	b := NewMemory(FANOUT)
+	defer b.Close()
+	msgs, _ := b.Consume("ex", "q", nil)
+	b.Publish("ex", "", []byte("first"), "")
+	d := receive(t, msgs)
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(false); err == nil {
+		t.Error("acking a delivery twice succeeded")
+	}
+}
+
+func TestMemoryAckMultiple(t *testing.T) {
+	b := NewMemory(FANOUT)
+	defer b.Close()
+	msgs, _ := b.Consume("ex", "q", nil)
+	for _, body := range []string{"1", "2", "3"} {
+		b.Publish("ex", "", []byte(body), "")
+	}
+	receive(t, msgs)
+	second := receive(t, msgs)
+	third := receive(t, msgs)
+	if err := second.Nack(true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2"} {
+		if d := receive(t, msgs); string(d.Body) != want || !d.Redelivered {
+			t.Errorf("got %q redelivered %v, want %q redelivered", d.Body, d.Redelivered, want)
+		}
+	}
+	if err := third.Ack(false); err != nil {
+		t.Errorf("the third delivery was settled by a nack of the second: %v", err)
+	}
+}
+
+func TestMemoryCancelRequeues(t *testing.T) {
+	b := NewMemory(FANOUT)
+	defer b.Close()
+	msgs, _ := b.Consume("ex", "q", nil)
+	b.Publish("ex", "", []byte("first"), "")
+	receive(t, msgs)
+	b.Cancel("q")
+	if _, ok := <-msgs; ok {
+		t.Fatal("deliveries still open after Cancel")
+	}
+	if got := b.Pending("q"); got != 1 {
+		t.Fatalf("%d pending after Cancel, want the unacked one back", got)
+	}
+	msgs, _ = b.Consume("ex", "q", nil)
+	if d := receive(t, msgs); !d.Redelivered {
+		t.Error("the requeued delivery is not marked redelivered")
+	}
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	b := NewMemory(FANOUT)
+	defer b.Close()
+	b.Prefetch = 1
+	msgs, _ := b.Consume("ex", "q", nil)
+	for _, body := range []string{"1", "2", "3"} {
+		b.Publish("ex", "", []byte(body), "")
+	}
+	first := receive(t, msgs)
+	expectNone(t, msgs)
+	first.Ack(false)
+	receive(t, msgs)
+
+	b.SetPrefetch("q", 2)
+	receive(t, msgs)
+}
@@ -0,0 +1,610 @@
+package broker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/streadway/amqp"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	SHARDS_PREFIX     = "shards:"
+	DEFAULT_HEARTBEAT = 5 * time.Second
+	// LOCK_HEARTBEATS is the lifetime of the membership and of the shard
+	// locks in heartbeats.
+	LOCK_HEARTBEATS = 3
+	// DRAIN_TIMEOUT bounds the wait for the deliveries of a shard being
+	// given up to be settled.
+	DRAIN_TIMEOUT = time.Minute
+	DRAIN_POLL    = 100 * time.Millisecond
+)
+
+// Sharded splits every queue it consumes into Shards queues named
+// <queue>.<shard>, each bound to the routing keys ending in its shard, so all
+// metrics of a username land in the same one. The replicas consuming a queue
+// register in Redis and divide its shards by rendezvous hashing, so a joining
+// or leaving replica only moves the shards it gains or gives up. A replica
+// holds a lock on each shard it consumes, so no shard has two consumers
+// while replicas disagree on the membership. A shard is given up only once
+// every delivery this replica received from it is settled, and a replica that
+// cannot renew its locks stops consuming before they expire.
+//
+// Publishing goes straight to the wrapped Broker, whose exchange must be a
+// TOPIC for the shard bindings to route.
+type Sharded struct {
+	Broker
+	Redis     redisclient.Commands
+	Shards    int
+	Heartbeat time.Duration
+
+	member    string
+	mu        sync.Mutex
+	consumers []*shardConsumer
+	prefetch  map[string]int
+}
+
+func NewSharded(b Broker, client redisclient.Commands, shards int, heartbeat time.Duration) *Sharded {
+	if heartbeat <= 0 {
+		heartbeat = DEFAULT_HEARTBEAT
+	}
+	host, _ := os.Hostname()
+	return &Sharded{
+		Broker:    b,
+		Redis:     client,
+		Shards:    shards,
+		Heartbeat: heartbeat,
+		member:    fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		prefetch:  map[string]int{},
+	}
+}
+
+// ShardQueue names a shard of queue.
+func ShardQueue(queue string, shard int) string {
+	return queue + "." + strconv.Itoa(shard)
+}
+
+// ShardPatterns narrows a queue's binding patterns to one shard of the
+// metric.<name>.<shard> routing keys, keeping what they say of the other
+// words. Patterns that match no routing key of the shard are dropped, and an
+// error is returned when none is left, since binding no pattern would route
+// every key.
+func ShardPatterns(patterns []string, shard int) ([]string, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+	key := []string{"metric", "*", strconv.Itoa(shard)}
+	var narrowed []string
+	for _, pattern := range patterns {
+		narrowed = appendMissing(narrowed, intersectWords(strings.Split(pattern, "."), key, nil))
+	}
+	if len(narrowed) == 0 {
+		return nil, fmt.Errorf("bindings %s match no routing key of shard %d", strings.Join(patterns, ","), shard)
+	}
+	return narrowed, nil
+}
+
+// intersectWords lists the patterns of the keys both pattern and key match,
+// where key has no #. It walks them like matchWords.
+func intersectWords(pattern []string, key []string, prefix []string) []string {
+	if len(pattern) == 0 {
+		if len(key) > 0 {
+			return nil
+		}
+		return []string{strings.Join(prefix, ".")}
+	}
+	if pattern[0] == "#" {
+		var found []string
+		for i := 0; i <= len(key); i++ {
+			found = appendMissing(found, intersectWords(pattern[1:], key[i:], append(prefix[:len(prefix):len(prefix)], key[:i]...)))
+		}
+		return found
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	word := key[0]
+	switch {
+	case word == "*":
+		word = pattern[0]
+	case pattern[0] != "*" && pattern[0] != word:
+		return nil
+	}
+	return intersectWords(pattern[1:], key[1:], append(prefix[:len(prefix):len(prefix)], word))
+}
+
+// Owner is the member that shard belongs to: the one scoring highest for it.
+func Owner(members []string, shard int) string {
+	var (
+		owner string
+		best  uint64
+	)
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member + "/" + strconv.Itoa(shard)))
+		if score := mix(h.Sum64()); owner == "" || score > best {
+			owner, best = member, score
+		}
+	}
+	return owner
+}
+
+// mix spreads FNV's poorly mixed high bits (the finalizer of MurmurHash3),
+// without which names differing in one character rank the same on every
+// shard.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Declare declares every shard of queue.
+func (s *Sharded) Declare(exchange string, queue string, patterns []string) error {
+	for shard := 0; shard < s.Shards; shard++ {
+		narrowed, err := ShardPatterns(patterns, shard)
+		if err != nil {
+			return err
+		}
+		if err := s.Broker.Declare(exchange, ShardQueue(queue, shard), narrowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consume delivers the messages of the shards this replica owns, each shard
+// in order, and follows the rebalancing every Heartbeat.
+func (s *Sharded) Consume(exchange string, queue string, patterns []string) (<-chan amqp.Delivery, error) {
+	if err := s.Declare(exchange, queue, patterns); err != nil {
+		return nil, err
+	}
+	c := &shardConsumer{
+		sharded:  s,
+		exchange: exchange,
+		queue:    queue,
+		patterns: patterns,
+		members:  SHARDS_PREFIX + queue,
+		owned:    map[int]*ownedShard{},
+		out:      make(chan amqp.Delivery),
+		stop:     make(chan bool),
+	}
+	if err := c.rebalance(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.consumers = append(s.consumers, c)
+	s.mu.Unlock()
+	go c.loop()
+	return c.out, nil
+}
+
+// Depth sums the shards of queue this replica consumes, the lag it is
+// responsible for.
+func (s *Sharded) Depth(queue string) (int, error) {
+	var depth int
+	for _, name := range s.owned(queue) {
+		n, err := s.Broker.Depth(name)
+		if err != nil {
+			return 0, err
+		}
+		depth += n
+	}
+	return depth, nil
+}
+
+// SetPrefetch applies to every shard of queue this replica consumes now or
+// takes later.
+func (s *Sharded) SetPrefetch(queue string, prefetch int) error {
+	s.mu.Lock()
+	s.prefetch[queue] = prefetch
+	s.mu.Unlock()
+	for _, name := range s.owned(queue) {
+		if err := s.Broker.SetPrefetch(name, prefetch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sharded) owned(queue string) []string {
+	s.mu.Lock()
+	consumers := append([]*shardConsumer{}, s.consumers...)
+	s.mu.Unlock()
+	var names []string
+	for _, c := range consumers {
+		if c.queue != queue {
+			continue
+		}
+		c.mu.Lock()
+		for shard, o := range c.owned {
+			if o.deadline.IsZero() {
+				names = append(names, ShardQueue(queue, shard))
+			}
+		}
+		c.mu.Unlock()
+	}
+	return names
+}
+
+// Cancel leaves the membership of queue, so the other replicas take its
+// shards over, and closes the deliveries once the ones handed out are
+// settled. It does not wait for that, since a handler may call it.
+func (s *Sharded) Cancel(queue string) error {
+	s.mu.Lock()
+	var left, kept []*shardConsumer
+	for _, c := range s.consumers {
+		if c.queue == queue {
+			left = append(left, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	s.consumers = kept
+	s.mu.Unlock()
+	for _, c := range left {
+		c.leave()
+	}
+	return nil
+}
+
+// Close leaves every membership like Cancel, waits for the shards to be
+// released and closes the wrapped Broker.
+func (s *Sharded) Close() error {
+	s.mu.Lock()
+	consumers := s.consumers
+	s.consumers = nil
+	s.mu.Unlock()
+	var left []<-chan bool
+	for _, c := range consumers {
+		left = append(left, c.leave())
+	}
+	for _, done := range left {
+		<-done
+	}
+	return s.Broker.Close()
+}
+
+type shardConsumer struct {
+	sharded  *Sharded
+	exchange string
+	queue    string
+	patterns []string
+	members  string
+	out      chan amqp.Delivery
+	stop     chan bool
+	// forwarders are the goroutines copying the shards into out, drains
+	// the ones giving shards up.
+	forwarders sync.WaitGroup
+	drains     sync.WaitGroup
+
+	mu    sync.Mutex
+	owned map[int]*ownedShard
+}
+
+// ownedShard is a shard this replica holds the lock of.
+type ownedShard struct {
+	lock *redisclient.Lock
+	// renewed is when the lock was last extended.
+	renewed time.Time
+	// stop ends the forwarding and forwarded is closed once it has ended;
+	// acker tracks what was forwarded.
+	stop      chan bool
+	forwarded chan bool
+	acker     *shardAcker
+	// deadline is set once the shard is given up: it is cancelled when its
+	// deliveries are settled or at deadline, whichever comes first.
+	deadline time.Time
+}
+
+func (c *shardConsumer) lockTTL() time.Duration {
+	return LOCK_HEARTBEATS * c.sharded.Heartbeat
+}
+
+// loop rebalances every heartbeat. After leave it only keeps the locks of
+// the shards still draining.
+func (c *shardConsumer) loop() {
+	ticker := time.NewTicker(c.sharded.Heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.stopped() && c.drained() {
+			return
+		}
+		if err := c.rebalance(); err != nil {
+			logger.Errorf("Failed to rebalance shards of %s. ERR: %+v", c.queue, err)
+		}
+		c.fence()
+	}
+}
+
+func (c *shardConsumer) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *shardConsumer) drained() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.owned) == 0
+}
+
+// rebalance renews this replica's membership and locks, gives up the shards
+// that now belong to others and takes the ones that became its own.
+func (c *shardConsumer) rebalance() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var members []string
+	stopped := c.stopped()
+	if !stopped {
+		var err error
+		if members, err = c.heartbeat(); err != nil {
+			return err
+		}
+	}
+	s := c.sharded
+	var failed error
+	for shard := 0; shard < s.Shards; shard++ {
+		o, owned := c.owned[shard]
+		mine := !stopped && Owner(members, shard) == s.member
+		switch {
+		case owned:
+			// Shards being given up keep their lock until they are drained.
+			held, err := o.lock.Extend(s.Redis)
+			if err != nil {
+				failed = err
+				continue
+			}
+			if !held {
+				logger.Errorf("Lost the lock of %s", ShardQueue(c.queue, shard))
+				c.retire(shard, o, time.Now())
+				continue
+			}
+			o.renewed = time.Now()
+			if !mine {
+				c.retire(shard, o, time.Now().Add(DRAIN_TIMEOUT))
+			}
+		case mine:
+			if err := c.take(shard); err != nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+// fence stops the shards whose lock could not be renewed for all but a
+// heartbeat of its lifetime, before another replica may take it.
+func (c *shardConsumer) fence() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for shard, o := range c.owned {
+		expiry := o.renewed.Add(c.lockTTL())
+		if time.Now().Before(expiry.Add(-c.sharded.Heartbeat)) {
+			continue
+		}
+		if o.deadline.IsZero() {
+			logger.Errorf("Could not renew the lock of %s since %s, stopping it", ShardQueue(c.queue, shard), o.renewed)
+		}
+		c.retire(shard, o, expiry)
+	}
+}
+
+// heartbeat registers this replica for the lifetime of the locks and lists
+// the members still registered.
+func (c *shardConsumer) heartbeat() ([]string, error) {
+	s := c.sharded
+	now := time.Now()
+	expiry := float64(now.Add(c.lockTTL()).UnixNano()) / 1e9
+	if err := s.Redis.ZAdd(c.members, redis.Z{Score: expiry, Member: s.member}).Err(); err != nil {
+		return nil, err
+	}
+	nowScore := strconv.FormatFloat(float64(now.UnixNano())/1e9, 'f', -1, 64)
+	if err := s.Redis.ZRemRangeByScore(c.members, "-inf", nowScore).Err(); err != nil {
+		return nil, err
+	}
+	return s.Redis.ZRangeByScore(c.members, redis.ZRangeByScore{Min: nowScore, Max: "+inf"}).Result()
+}
+
+// take consumes a shard once its previous owner has let go of the lock.
+func (c *shardConsumer) take(shard int) error {
+	s := c.sharded
+	name := ShardQueue(c.queue, shard)
+	lock := redisclient.NewLock(SHARDS_PREFIX+name, c.lockTTL())
+	acquired, err := lock.Acquire(s.Redis)
+	if err != nil || !acquired {
+		return err
+	}
+	patterns, err := ShardPatterns(c.patterns, shard)
+	if err != nil {
+		lock.Release(s.Redis)
+		return err
+	}
+	msgs, err := s.Broker.Consume(c.exchange, name, patterns)
+	if err != nil {
+		lock.Release(s.Redis)
+		return err
+	}
+	o := &ownedShard{
+		lock:      lock,
+		renewed:   time.Now(),
+		stop:      make(chan bool),
+		forwarded: make(chan bool),
+		acker:     &shardAcker{outstanding: map[uint64]bool{}},
+	}
+	c.owned[shard] = o
+	s.mu.Lock()
+	prefetch, ok := s.prefetch[c.queue]
+	s.mu.Unlock()
+	if ok {
+		if err := s.Broker.SetPrefetch(name, prefetch); err != nil {
+			logger.Errorf("Failed to set the prefetch of %s. ERR: %+v", name, err)
+		}
+	}
+	logger.Infof("Consuming %s", name)
+	c.forwarders.Add(1)
+	go c.forward(msgs, o)
+	return nil
+}
+
+// forward hands the deliveries of a shard out until it is stopped. What it
+// has not handed out is requeued when the shard is cancelled.
+func (c *shardConsumer) forward(msgs <-chan amqp.Delivery, o *ownedShard) {
+	defer c.forwarders.Done()
+	defer close(o.forwarded)
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return
+			}
+			o.acker.add(d)
+			d.Acknowledger = o.acker
+			select {
+			case c.out <- d:
+			case <-o.stop:
+				o.acker.remove(d.DeliveryTag)
+				return
+			}
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// retire gives a shard up. The forwarding stops right away; the shard is
+// cancelled and its lock released once every delivery handed out from it is
+// settled, so the next owner does not handle a message before this replica
+// is done with the ones before it, or at deadline. Called with c.mu held.
+func (c *shardConsumer) retire(shard int, o *ownedShard, deadline time.Time) {
+	if !o.deadline.IsZero() {
+		if deadline.Before(o.deadline) {
+			o.deadline = deadline
+		}
+		return
+	}
+	o.deadline = deadline
+	close(o.stop)
+	c.drains.Add(1)
+	go func() {
+		defer c.drains.Done()
+		<-o.forwarded
+		for o.acker.pending() > 0 {
+			c.mu.Lock()
+			expired := time.Now().After(o.deadline)
+			c.mu.Unlock()
+			if expired {
+				logger.Warnf("Giving up %s with %d deliveries unsettled", ShardQueue(c.queue, shard), o.acker.pending())
+				break
+			}
+			time.Sleep(DRAIN_POLL)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.release(shard, o)
+	}()
+}
+
+func (c *shardConsumer) release(shard int, o *ownedShard) {
+	s := c.sharded
+	name := ShardQueue(c.queue, shard)
+	if err := s.Broker.Cancel(name); err != nil {
+		logger.Errorf("Failed to cancel %s. ERR: %+v", name, err)
+	}
+	if err := o.lock.Release(s.Redis); err != nil {
+		logger.Errorf("Failed to release %s. ERR: %+v", name, err)
+	}
+	if c.owned[shard] == o {
+		delete(c.owned, shard)
+	}
+	logger.Infof("Released %s", name)
+}
+
+// leave gives every shard up and leaves the membership. The returned
+// channel is closed with the deliveries once the shards are released.
+func (c *shardConsumer) leave() <-chan bool {
+	c.mu.Lock()
+	close(c.stop)
+	for shard, o := range c.owned {
+		c.retire(shard, o, time.Now().Add(DRAIN_TIMEOUT))
+	}
+	c.mu.Unlock()
+	c.sharded.Redis.ZRem(c.members, c.sharded.member)
+	done := make(chan bool)
+	go func() {
+		c.forwarders.Wait()
+		c.drains.Wait()
+		close(c.out)
+		close(done)
+	}()
+	return done
+}
+
+// shardAcker settles the deliveries of a shard on the channel they came
+// from and keeps track of the ones handed out and not settled yet.
+type shardAcker struct {
+	mu          sync.Mutex
+	channel     amqp.Acknowledger
+	outstanding map[uint64]bool
+}
+
+func (a *shardAcker) add(d amqp.Delivery) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.channel = d.Acknowledger
+	a.outstanding[d.DeliveryTag] = true
+}
+
+func (a *shardAcker) remove(tag uint64) {
+	a.settle(tag, false)
+}
+
+// settle forgets tag, or with multiple every tag up to it.
+func (a *shardAcker) settle(tag uint64, multiple bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t := range a.outstanding {
+		if t == tag || (multiple && (tag == 0 || t <= tag)) {
+			delete(a.outstanding, t)
+		}
+	}
+}
+
+func (a *shardAcker) pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.outstanding)
+}
+
+func (a *shardAcker) acknowledger() amqp.Acknowledger {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.channel
+}
+
+func (a *shardAcker) Ack(tag uint64, multiple bool) error {
+	defer a.settle(tag, multiple)
+	return a.acknowledger().Ack(tag, multiple)
+}
+
+func (a *shardAcker) Nack(tag uint64, multiple bool, requeue bool) error {
+	defer a.settle(tag, multiple)
+	return a.acknowledger().Nack(tag, multiple, requeue)
+}
+
+func (a *shardAcker) Reject(tag uint64, requeue bool) error {
+	defer a.settle(tag, false)
+	return a.acknowledger().Reject(tag, requeue)
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShardPatterns(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		shard    int
+		want     []string
+	}{
+		{nil, 3, []string{"metric.*.3"}},
+		{[]string{"#"}, 0, []string{"metric.*.0"}},
+		{[]string{"metric.#"}, 1, []string{"metric.*.1"}},
+		{[]string{"metric.login"}, 2, nil},
+		{[]string{"metric.login.*"}, 2, []string{"metric.login.2"}},
+		{[]string{"metric.login.#"}, 2, []string{"metric.login.2"}},
+		{[]string{"metric.login.*", "metric.logout.*"}, 2, []string{"metric.login.2", "metric.logout.2"}},
+		{[]string{"metric.login.#", "metric.login.*"}, 2, []string{"metric.login.2"}},
+		{[]string{"*.login.#"}, 2, []string{"metric.login.2"}},
+		{[]string{"#.login.#"}, 2, []string{"metric.login.2"}},
+		{[]string{"metric.*.3"}, 2, nil},
+		{[]string{"metric.*.3"}, 3, []string{"metric.*.3"}},
+		{[]string{"metric.*.3", "metric.login.*"}, 2, []string{"metric.login.2"}},
+		{[]string{"other.login"}, 2, nil},
+		{[]string{"#.2"}, 2, []string{"metric.*.2"}},
+	}
+	for _, c := range cases {
+		got, err := ShardPatterns(c.patterns, c.shard)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("ShardPatterns(%v, %d) = %v, want an error", c.patterns, c.shard, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ShardPatterns(%v, %d) = %v, %v, want %v", c.patterns, c.shard, got, err, c.want)
+		}
+	}
+}
+
+func TestShardPatternsRouteTheShardOnly(t *testing.T) {
+	patterns, err := ShardPatterns([]string{"metric.login.*"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key  string
+		want bool
+	}{
+		{"metric.login.1", true},
+		{"metric.login.2", false},
+		{"metric.logout.1", false},
+	}
+	for _, c := range cases {
+		if got := routes(TOPIC, patterns, c.key); got != c.want {
+			t.Errorf("shard 1 of metric.login.* routes %q: %v, want %v", c.key, got, c.want)
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	cases := []struct {
+		members []string
+		shard   int
+	}{
+		{[]string{"a"}, 0},
+		{[]string{"a", "b"}, 0},
+		{[]string{"a", "b", "c"}, 5},
+		{[]string{"worker-1", "worker-2", "worker-3", "worker-4"}, 7},
+	}
+	for _, c := range cases {
+		owner := Owner(c.members, c.shard)
+		found := false
+		for _, member := range c.members {
+			found = found || member == owner
+		}
+		if !found {
+			t.Errorf("Owner(%v, %d) = %q, not a member", c.members, c.shard, owner)
+		}
+		reversed := make([]string, len(c.members))
+		for i, member := range c.members {
+			reversed[len(c.members)-1-i] = member
+		}
+		if got := Owner(reversed, c.shard); got != owner {
+			t.Errorf("Owner(%v, %d) = %q, but %q in another order", c.members, c.shard, got, owner)
+		}
+	}
+	if got := Owner(nil, 0); got != "" {
+		t.Errorf("Owner(nil, 0) = %q, want none", got)
+	}
+}
+
+// A member leaving only moves its own shards, and every member gets some.
+func TestOwnerRebalance(t *testing.T) {
+	const shards = 64
+	members := []string{"worker-1", "worker-2", "worker-3", "worker-4"}
+	counts := map[string]int{}
+	for shard := 0; shard < shards; shard++ {
+		owner := Owner(members, shard)
+		counts[owner]++
+		remaining := []string{}
+		for _, member := range members {
+			if member != "worker-2" {
+				remaining = append(remaining, member)
+			}
+		}
+		if after := Owner(remaining, shard); owner != "worker-2" && after != owner {
+			t.Errorf("shard %d moved from %s to %s when worker-2 left", shard, owner, after)
+		}
+	}
+	for _, member := range members {
+		if counts[member] == 0 {
+			t.Errorf("%s owns none of %d shards: %v", member, shards, counts)
+		}
+	}
+}
@@ -0,0 +1,715 @@
+package broker
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/streadway/amqp"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	STREAM_PREFIX       = "stream:"
+	DEFAULT_CLAIM_AFTER = 30 * time.Second
+	READ_COUNT          = 10
+	READ_BLOCK_MS       = 1000
+	PENDING_COUNT       = 100
+	DEPTH_LIMIT         = 10000
+)
+
+// deleteConsumerScript deletes a consumer from its group unless it still
+// has pending entries, which XGROUP DELCONSUMER would drop with it.
+const deleteConsumerScript = `
+if #redis.call("XPENDING", KEYS[1], ARGV[1], "-", "+", 1, ARGV[2]) == 0 then
+	return redis.call("XGROUP", "DELCONSUMER", KEYS[1], ARGV[1], ARGV[2])
+end
+return -1`
+
+var consumerSeq struct {
+	sync.Mutex
+	n int
+}
+
+// Streams is a Broker on Redis Streams (Redis 5 or later). An exchange is the
+// stream "stream:<exchange>" and every queue is a consumer group on it, so
+// each queue sees every message while the consumers of a queue share them.
+// For a TOPIC Kind, consumers ack the entries their patterns do not match
+// without delivering them.
+//
+// Entries stay pending in their group until acked. Entries left pending by a
+// consumer that is gone for ClaimAfter are claimed by another one, and a
+// requeuing nack has the same consumer claim the entry again right away. A
+// nack without requeue drops the entries from the group, like RabbitMQ drops
+// a rejected message of a queue without a dead-letter exchange.
+//
+// Every ClaimAfter the consumers trim the entries all groups are done with
+// (XTRIM MINID, Redis 6.2 or later), so the streams do not grow without
+// MaxLen. A cancelled consumer leaves its group once it has settled its
+// deliveries, and so does one left idle for ClaimAfter with nothing pending,
+// like the consumers of a process that is gone.
+type Streams struct {
+	Client     redisclient.Client
+	Kind       string
+	ClaimAfter time.Duration
+	// MaxLen caps each stream at about that many entries, 0 keeps all.
+	MaxLen int64
+	// Prefetch caps the unacked deliveries of each consumer, 0 leaves them
+	// unlimited.
+	Prefetch int
+
+	mu        sync.Mutex
+	consumers []*streamConsumer
+	closed    bool
+}
+
+func NewStreams(client redisclient.Client, kind string, claimAfter time.Duration, maxLen int64) *Streams {
+	if kind == "" {
+		kind = FANOUT
+	}
+	if claimAfter <= 0 {
+		claimAfter = DEFAULT_CLAIM_AFTER
+	}
+	return &Streams{Client: client, Kind: kind, ClaimAfter: claimAfter, MaxLen: maxLen}
+}
+
+func streamKey(exchange string) string {
+	return STREAM_PREFIX + exchange
+}
+
+// Declare creates the group at the end of the stream, like a new queue that
+// only receives what is published after it. Redis keeps no bindings, the
+// patterns only apply to consumers.
+func (b *Streams) Declare(exchange string, queue string, patterns []string) error {
+	cmd := redis.NewCmd("XGROUP", "CREATE", streamKey(exchange), queue, "$", "MKSTREAM")
+	b.Client.Process(cmd)
+	err := cmd.Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating group %s on %s: %v", queue, streamKey(exchange), err)
+	}
+	return nil
+}
+
+// Publish appends the message to the exchange's stream. Redis replying with
+// the entry id is the confirmation.
+func (b *Streams) Publish(exchange string, key string, body []byte, correlationID string) error {
+	args := []interface{}{"XADD", streamKey(exchange)}
+	if b.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", b.MaxLen)
+	}
+	args = append(args, "*", "key", key, "body", string(body))
+	if correlationID != "" {
+		args = append(args, "correlation-id", correlationID)
+	}
+	cmd := redis.NewStringCmd(args...)
+	b.Client.Process(cmd)
+	if err := cmd.Err(); err != nil {
+		return fmt.Errorf("publishing to %s: %v", streamKey(exchange), err)
+	}
+	return nil
+}
+
+func (b *Streams) Consume(exchange string, queue string, patterns []string) (<-chan amqp.Delivery, error) {
+	if err := b.Declare(exchange, queue, patterns); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	c := &streamConsumer{
+		broker:     b,
+		exchange:   exchange,
+		key:        streamKey(exchange),
+		group:      queue,
+		patterns:   patterns,
+		name:       consumerName(),
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan bool),
+		freed:      make(chan bool, 1),
+		prefetch:   b.Prefetch,
+		ids:        map[uint64]string{},
+	}
+	b.consumers = append(b.consumers, c)
+	go c.loop()
+	return c.deliveries, nil
+}
+
+// Cancel stops the consumers of the queue's group. What they had not acked
+// stays pending until another consumer claims it.
+func (b *Streams) Cancel(queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var kept []*streamConsumer
+	for _, c := range b.consumers {
+		if c.group == queue {
+			close(c.stop)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	b.consumers = kept
+	return nil
+}
+
+// Close stops the consumers like Cancel and closes the client.
+func (b *Streams) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, c := range b.consumers {
+		close(c.stop)
+	}
+	b.consumers = nil
+	return b.Client.Close()
+}
+
+// Depth is the group's lag on Redis 7 and later. Older versions do not
+// track it, so the entries after the group's last delivered one are counted,
+// up to DEPTH_LIMIT.
+func (b *Streams) Depth(queue string) (int, error) {
+	var depth int
+	for _, exchange := range b.exchangesOf(queue) {
+		groups, err := b.groups(streamKey(exchange))
+		if err != nil {
+			return 0, err
+		}
+		for _, info := range groups {
+			if info["name"] != queue {
+				continue
+			}
+			if lag, ok := info["lag"].(int64); ok {
+				depth += int(lag)
+				continue
+			}
+			last, _ := info["last-delivered-id"].(string)
+			n, err := b.countAfter(streamKey(exchange), last)
+			if err != nil {
+				return 0, err
+			}
+			depth += n
+		}
+	}
+	return depth, nil
+}
+
+// groups reads XINFO GROUPS of the stream at key.
+func (b *Streams) groups(key string) ([]map[string]interface{}, error) {
+	cmd := redis.NewCmd("XINFO", "GROUPS", key)
+	b.Client.Process(cmd)
+	val, err := cmd.Result()
+	if err != nil {
+		return nil, fmt.Errorf("reading groups of %s: %v", key, err)
+	}
+	var groups []map[string]interface{}
+	list, _ := val.([]interface{})
+	for _, group := range list {
+		groups = append(groups, fieldMap(group))
+	}
+	return groups, nil
+}
+
+// deleteConsumer removes the consumer name from the group unless it has
+// pending entries.
+func (b *Streams) deleteConsumer(key string, group string, name string) error {
+	err := b.Client.Eval(deleteConsumerScript, []string{key}, []string{group, name}).Err()
+	if err != nil {
+		return fmt.Errorf("deleting consumer %s of %s: %v", name, group, err)
+	}
+	return nil
+}
+
+// oldestNeeded is the id of the oldest entry a group of the stream at key
+// still needs: its oldest pending entry, or else the last one it was
+// delivered. Every entry before it has been acked by every group.
+func (b *Streams) oldestNeeded(key string) (string, error) {
+	groups, err := b.groups(key)
+	if err != nil {
+		return "", err
+	}
+	oldest := ""
+	for _, info := range groups {
+		id, _ := info["last-delivered-id"].(string)
+		if pending, _ := info["pending"].(int64); pending > 0 {
+			cmd := redis.NewSliceCmd("XPENDING", key, info["name"])
+			b.Client.Process(cmd)
+			summary, err := cmd.Result()
+			if err != nil {
+				return "", err
+			}
+			// The summary is [count, smallest id, greatest id, consumers].
+			if len(summary) > 1 {
+				if smallest, ok := summary[1].(string); ok {
+					id = smallest
+				}
+			}
+		}
+		if id != "" && (oldest == "" || lessID(id, oldest)) {
+			oldest = id
+		}
+	}
+	return oldest, nil
+}
+
+// lessID compares two entry ids, <ms>-<seq>.
+func lessID(a string, b string) bool {
+	aMs, aSeq := splitID(a)
+	bMs, bSeq := splitID(b)
+	return aMs < bMs || (aMs == bMs && aSeq < bSeq)
+}
+
+func splitID(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	var seq uint64
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
+
+func (b *Streams) countAfter(key string, id string) (int, error) {
+	cmd := redis.NewSliceCmd("XRANGE", key, id, "+", "COUNT", DEPTH_LIMIT+1)
+	b.Client.Process(cmd)
+	entries, err := cmd.Result()
+	if err != nil {
+		return 0, fmt.Errorf("counting entries of %s: %v", key, err)
+	}
+	n := len(entries)
+	// The range starts at the last delivered entry itself.
+	if n > 0 {
+		if first, ok := entries[0].([]interface{}); ok && len(first) > 0 && first[0] == id {
+			n--
+		}
+	}
+	return n, nil
+}
+
+// exchangesOf lists the streams this broker consumes queue from.
+func (b *Streams) exchangesOf(queue string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var exchanges []string
+	for _, c := range b.consumers {
+		if c.group == queue {
+			exchanges = appendMissing(exchanges, []string{c.exchange})
+		}
+	}
+	return exchanges
+}
+
+// fieldMap reads a [name, value, ...] reply.
+func fieldMap(val interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	list, _ := val.([]interface{})
+	for i := 0; i+1 < len(list); i += 2 {
+		if name, ok := list[i].(string); ok {
+			fields[name] = list[i+1]
+		}
+	}
+	return fields
+}
+
+func (b *Streams) SetPrefetch(queue string, prefetch int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.consumers {
+		if c.group == queue {
+			c.mu.Lock()
+			c.prefetch = prefetch
+			c.mu.Unlock()
+			c.free()
+		}
+	}
+	return nil
+}
+
+func consumerName() string {
+	consumerSeq.Lock()
+	defer consumerSeq.Unlock()
+	consumerSeq.n++
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), consumerSeq.n)
+}
+
+type streamEntry struct {
+	id            string
+	key           string
+	body          []byte
+	correlationID string
+}
+
+type streamConsumer struct {
+	broker     *Streams
+	exchange   string
+	key        string
+	group      string
+	patterns   []string
+	name       string
+	deliveries chan amqp.Delivery
+	stop       chan bool
+	lastClaim  time.Time
+	lastTrim   time.Time
+	// noTrim is set once Redis turns XTRIM MINID down.
+	noTrim bool
+	// freed wakes a loop waiting for deliveries to be acked.
+	freed chan bool
+
+	mu       sync.Mutex
+	prefetch int
+	tag      uint64
+	ids      map[uint64]string
+	requeued []string
+}
+
+func (c *streamConsumer) loop() {
+	defer c.retire()
+	defer close(c.deliveries)
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if time.Since(c.lastTrim) >= c.broker.ClaimAfter {
+			c.lastTrim = time.Now()
+			if !c.noTrim {
+				c.trim()
+			}
+			c.prune()
+		}
+		entries, redelivered, err := c.next()
+		if err != nil {
+			logger.Errorf("Failed to read %s of %s. ERR: %+v", c.group, c.key, err)
+			select {
+			case <-time.After(time.Second):
+			case <-c.stop:
+				return
+			}
+			continue
+		}
+		var skipped []string
+		for _, e := range entries {
+			if !routes(c.broker.Kind, c.patterns, e.key) {
+				skipped = append(skipped, e.id)
+				continue
+			}
+			for c.full() {
+				select {
+				case <-c.freed:
+				case <-c.stop:
+					return
+				}
+			}
+			select {
+			case c.deliveries <- c.delivery(e, redelivered):
+			case <-c.stop:
+				return
+			}
+		}
+		if len(skipped) > 0 {
+			if err := c.xack(skipped); err != nil {
+				logger.Errorf("Failed to skip %d entries of %s. ERR: %+v", len(skipped), c.key, err)
+			}
+		}
+	}
+}
+
+// trim deletes the entries of the stream that every group has acked.
+func (c *streamConsumer) trim() {
+	oldest, err := c.broker.oldestNeeded(c.key)
+	if err != nil {
+		logger.Errorf("Failed to read the groups of %s. ERR: %+v", c.key, err)
+		return
+	}
+	if oldest == "" {
+		return
+	}
+	cmd := redis.NewIntCmd("XTRIM", c.key, "MINID", oldest)
+	c.broker.Client.Process(cmd)
+	err = cmd.Err()
+	if err != nil && strings.HasPrefix(err.Error(), "ERR") {
+		logger.Warnf("Not trimming %s, XTRIM MINID needs Redis 6.2; set redis-stream-maxlen instead. ERR: %+v", c.key, err)
+		c.noTrim = true
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to trim %s. ERR: %+v", c.key, err)
+	}
+}
+
+// prune deletes the other consumers of the group that have nothing pending
+// and have been idle for ClaimAfter.
+func (c *streamConsumer) prune() {
+	cmd := redis.NewCmd("XINFO", "CONSUMERS", c.key, c.group)
+	c.broker.Client.Process(cmd)
+	val, err := cmd.Result()
+	if err != nil {
+		logger.Errorf("Failed to read the consumers of %s. ERR: %+v", c.group, err)
+		return
+	}
+	list, _ := val.([]interface{})
+	for _, consumer := range list {
+		info := fieldMap(consumer)
+		name, _ := info["name"].(string)
+		pending, _ := info["pending"].(int64)
+		idle, _ := info["idle"].(int64)
+		if name == "" || name == c.name || pending > 0 || time.Duration(idle)*time.Millisecond < c.broker.ClaimAfter {
+			continue
+		}
+		if err := c.broker.deleteConsumer(c.key, c.group, name); err != nil {
+			logger.Errorf("Failed to prune %s. ERR: %+v", c.group, err)
+		}
+	}
+}
+
+// retire deletes a cancelled consumer from its group once every delivery it
+// made is settled. Entries nacked meanwhile stay pending with it until
+// another consumer claims them and prunes it, as do the consumers of a
+// closed broker.
+func (c *streamConsumer) retire() {
+	select {
+	case <-c.stop:
+	default:
+		return
+	}
+	c.broker.mu.Lock()
+	closed := c.broker.closed
+	c.broker.mu.Unlock()
+	if closed {
+		return
+	}
+	c.mu.Lock()
+	settled := len(c.ids) == 0
+	c.mu.Unlock()
+	if !settled {
+		return
+	}
+	if err := c.broker.deleteConsumer(c.key, c.group, c.name); err != nil {
+		logger.Errorf("Failed to retire from %s. ERR: %+v", c.group, err)
+	}
+}
+
+// next returns the nacked entries to redeliver first, then stale entries of
+// other consumers and otherwise new ones.
+func (c *streamConsumer) next() ([]streamEntry, bool, error) {
+	c.mu.Lock()
+	requeued := c.requeued
+	c.requeued = nil
+	c.mu.Unlock()
+	if len(requeued) > 0 {
+		entries, err := c.claim(0, requeued)
+		return entries, true, err
+	}
+
+	if time.Since(c.lastClaim) >= c.broker.ClaimAfter/2 {
+		c.lastClaim = time.Now()
+		stale, err := c.stale()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(stale) > 0 {
+			entries, err := c.claim(c.broker.ClaimAfter, stale)
+			if len(entries) > 0 || err != nil {
+				return entries, true, err
+			}
+		}
+	}
+
+	cmd := redis.NewCmd("XREADGROUP", "GROUP", c.group, c.name,
+		"COUNT", READ_COUNT, "BLOCK", READ_BLOCK_MS, "STREAMS", c.key, ">")
+	c.broker.Client.Process(cmd)
+	val, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// The reply holds one [stream, entries] pair per stream read.
+	var entries []streamEntry
+	streams, _ := val.([]interface{})
+	for _, stream := range streams {
+		if pair, ok := stream.([]interface{}); ok && len(pair) == 2 {
+			entries = append(entries, parseEntries(pair[1])...)
+		}
+	}
+	return entries, false, nil
+}
+
+// stale lists the entries other consumers of the group left pending for at
+// least ClaimAfter.
+func (c *streamConsumer) stale() ([]string, error) {
+	cmd := redis.NewSliceCmd("XPENDING", c.key, c.group, "-", "+", PENDING_COUNT)
+	c.broker.Client.Process(cmd)
+	pending, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, p := range pending {
+		// Each is [id, consumer, idle ms, deliveries].
+		fields, ok := p.([]interface{})
+		if !ok || len(fields) < 3 {
+			continue
+		}
+		id, _ := fields[0].(string)
+		consumer, _ := fields[1].(string)
+		idle, _ := fields[2].(int64)
+		if id != "" && consumer != c.name && time.Duration(idle)*time.Millisecond >= c.broker.ClaimAfter {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *streamConsumer) claim(minIdle time.Duration, ids []string) ([]streamEntry, error) {
+	args := []interface{}{"XCLAIM", c.key, c.group, c.name, int64(minIdle / time.Millisecond)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	cmd := redis.NewSliceCmd(args...)
+	c.broker.Client.Process(cmd)
+	val, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(val), nil
+}
+
+// parseEntries reads [[id, [field, value, ...]], ...], skipping entries that
+// were trimmed from the stream meanwhile.
+func parseEntries(val interface{}) []streamEntry {
+	var entries []streamEntry
+	list, _ := val.([]interface{})
+	for _, item := range list {
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		e := streamEntry{}
+		e.id, _ = entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := fields[i].(string)
+			value, _ := fields[i+1].(string)
+			switch name {
+			case "key":
+				e.key = value
+			case "body":
+				e.body = []byte(value)
+			case "correlation-id":
+				e.correlationID = value
+			}
+		}
+		if e.body != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (c *streamConsumer) delivery(e streamEntry, redelivered bool) amqp.Delivery {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tag++
+	c.ids[c.tag] = e.id
+	return amqp.Delivery{
+		Acknowledger:  c,
+		ContentType:   "application/json",
+		CorrelationId: e.correlationID,
+		MessageId:     e.id,
+		ConsumerTag:   c.group,
+		DeliveryTag:   c.tag,
+		Redelivered:   redelivered,
+		Exchange:      c.exchange,
+		RoutingKey:    e.key,
+		Body:          e.body,
+	}
+}
+
+// take removes the entries an ack of tag covers, in delivery order.
+func (c *streamConsumer) take(tag uint64, multiple bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tags []uint64
+	for t := range c.ids {
+		if t == tag || (multiple && (tag == 0 || t <= tag)) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Sort(uint64s(tags))
+	ids := make([]string, len(tags))
+	for i, t := range tags {
+		ids[i] = c.ids[t]
+		delete(c.ids, t)
+	}
+	c.free()
+	return ids
+}
+
+func (c *streamConsumer) full() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prefetch > 0 && len(c.ids) >= c.prefetch
+}
+
+func (c *streamConsumer) free() {
+	select {
+	case c.freed <- true:
+	default:
+	}
+}
+
+func (c *streamConsumer) xack(ids []string) error {
+	args := []interface{}{"XACK", c.key, c.group}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	cmd := redis.NewIntCmd(args...)
+	c.broker.Client.Process(cmd)
+	return cmd.Err()
+}
+
+func (c *streamConsumer) Ack(tag uint64, multiple bool) error {
+	ids := c.take(tag, multiple)
+	if len(ids) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	defer c.retire()
+	return c.xack(ids)
+}
+
+// Nack without requeue drops the entries from the group. Acking is how a
+// group lets go of an entry; the other groups keep theirs.
+func (c *streamConsumer) Nack(tag uint64, multiple bool, requeue bool) error {
+	ids := c.take(tag, multiple)
+	if len(ids) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	defer c.retire()
+	if !requeue {
+		return c.xack(ids)
+	}
+	c.mu.Lock()
+	c.requeued = append(c.requeued, ids...)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *streamConsumer) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
@@ -0,0 +1,276 @@
+package broker
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/streadway/amqp"
+	redis "gopkg.in/redis.v3"
+)
+
+// These tests need a Redis 6.2 or later at REDIS_URL (host:port), which they
+// write streams named after the test to.
+
+type redisOptions map[string]string
+
+func (o redisOptions) String(section string, option string) (string, error) {
+	if value, ok := o[option]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("option %s not found", option)
+}
+
+func (o redisOptions) Int(section string, option string) (int, error) {
+	value, err := o.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func newTestStreams(t *testing.T, claimAfter time.Duration) *Streams {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	client, err := redisclient.New(redisOptions{"redis-url": url}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+	return NewStreams(client, FANOUT, claimAfter, 0)
+}
+
+// testExchange names a stream no earlier run left entries in.
+func testExchange(b *Streams, name string) string {
+	exchange := fmt.Sprintf("test-%s-%d", name, time.Now().UnixNano())
+	b.Client.Del(streamKey(exchange))
+	return exchange
+}
+
+// receiveWithin allows for a read blocking READ_BLOCK_MS before it sees an
+// entry.
+func receiveWithin(t *testing.T, msgs <-chan amqp.Delivery, timeout time.Duration) amqp.Delivery {
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(timeout):
+		t.Fatalf("no delivery within %s", timeout)
+	}
+	return amqp.Delivery{}
+}
+
+func TestStreamsFanOut(t *testing.T) {
+	b := newTestStreams(t, time.Minute)
+	defer b.Close()
+	exchange := testExchange(b, "fanout")
+	defer b.Client.Del(streamKey(exchange))
+
+	shared := []<-chan amqp.Delivery{}
+	for i := 0; i < 2; i++ {
+		msgs, err := b.Consume(exchange, "shared", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared = append(shared, msgs)
+	}
+	other, err := b.Consume(exchange, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"1", "2", "3", "4"} {
+		if err := b.Publish(exchange, "", []byte(body), "req-"+body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"1", "2", "3", "4"} {
+		d := receiveWithin(t, other, 3*time.Second)
+		if string(d.Body) != want || d.CorrelationId != "req-"+want {
+			t.Errorf("other got %q %q, want %q", d.Body, d.CorrelationId, want)
+		}
+		d.Ack(false)
+	}
+	seen := map[string]bool{}
+	deadline := time.After(3 * time.Second)
+	for len(seen) < 4 {
+		select {
+		case d := <-shared[0]:
+			seen[string(d.Body)] = true
+			d.Ack(false)
+		case d := <-shared[1]:
+			seen[string(d.Body)] = true
+			d.Ack(false)
+		case <-deadline:
+			t.Fatalf("the shared group got %v, want every message", seen)
+		}
+	}
+	for _, msgs := range shared {
+		expectNone(t, msgs)
+	}
+}
+
+func TestStreamsNack(t *testing.T) {
+	b := newTestStreams(t, time.Minute)
+	defer b.Close()
+	exchange := testExchange(b, "nack")
+	defer b.Client.Del(streamKey(exchange))
+
+	msgs, err := b.Consume(exchange, "q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish(exchange, "", []byte("first"), "")
+	d := receiveWithin(t, msgs, 3*time.Second)
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receiveWithin(t, msgs, 3*time.Second)
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("got %q redelivered %v, want the first message redelivered", d.Body, d.Redelivered)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, msgs)
+
+	groups, err := b.groups(streamKey(exchange))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range groups {
+		if pending, _ := info["pending"].(int64); info["name"] == "q" && pending != 0 {
+			t.Errorf("%d entries pending after a nack without requeue", pending)
+		}
+	}
+}
+
+// A consumer that stopped without acking leaves its entries to another one
+// after ClaimAfter.
+func TestStreamsClaim(t *testing.T) {
+	claimAfter := 200 * time.Millisecond
+	gone := newTestStreams(t, claimAfter)
+	defer gone.Close()
+	exchange := testExchange(gone, "claim")
+	defer gone.Client.Del(streamKey(exchange))
+
+	msgs, err := gone.Consume(exchange, "q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Publish(exchange, "", []byte("first"), "")
+	receiveWithin(t, msgs, 3*time.Second)
+	gone.Cancel("q")
+
+	b := newTestStreams(t, claimAfter)
+	defer b.Close()
+	msgs, err = b.Consume(exchange, "q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receiveWithin(t, msgs, 5*time.Second)
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("got %q redelivered %v, want the first message claimed", d.Body, d.Redelivered)
+	}
+	d.Ack(false)
+}
+
+func TestStreamsTrim(t *testing.T) {
+	b := newTestStreams(t, 200*time.Millisecond)
+	defer b.Close()
+	exchange := testExchange(b, "trim")
+	defer b.Client.Del(streamKey(exchange))
+
+	msgs, err := b.Consume(exchange, "q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"1", "2", "3"} {
+		b.Publish(exchange, "", []byte(body), "")
+	}
+	for i := 0; i < 3; i++ {
+		receiveWithin(t, msgs, 3*time.Second).Ack(false)
+	}
+
+	// The entry the group was delivered last is kept.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cmd := redis.NewIntCmd("XLEN", streamKey(exchange))
+		b.Client.Process(cmd)
+		if cmd.Val() <= 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries left, want the acked ones trimmed", cmd.Val())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestStreamsDepth(t *testing.T) {
+	b := newTestStreams(t, time.Minute)
+	defer b.Close()
+	exchange := testExchange(b, "depth")
+	defer b.Client.Del(streamKey(exchange))
+
+	if err := b.Declare(exchange, "q", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"1", "2", "3"} {
+		b.Publish(exchange, "", []byte(body), "")
+	}
+	// Depth covers the streams this broker consumes the queue from; a
+	// consumer that is not running keeps the entries waiting.
+	b.consumers = []*streamConsumer{{broker: b, exchange: exchange, key: streamKey(exchange), group: "q", stop: make(chan bool)}}
+	depth, err := b.Depth("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth != 3 {
+		t.Errorf("depth %d, want 3", depth)
+	}
+}
+
+// A cancelled consumer leaves its group once its delivery is acked.
+func TestStreamsCancelDeletesConsumer(t *testing.T) {
+	b := newTestStreams(t, time.Minute)
+	defer b.Close()
+	exchange := testExchange(b, "cancel")
+	defer b.Client.Del(streamKey(exchange))
+
+	msgs, err := b.Consume(exchange, "q", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish(exchange, "", []byte("first"), "")
+	d := receiveWithin(t, msgs, 3*time.Second)
+	b.Cancel("q")
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		cmd := redis.NewSliceCmd("XINFO", "CONSUMERS", streamKey(exchange), "q")
+		b.Client.Process(cmd)
+		if err := cmd.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(cmd.Val()) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumers %v left in the group", cmd.Val())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,47 @@
+package broker
+
+import "strings"
+
+const (
+	FANOUT = "fanout"
+	TOPIC  = "topic"
+)
+
+// MatchTopic reports whether a routing key matches a binding pattern the way
+// a topic exchange does: words are separated by dots, * stands for exactly
+// one word and # for zero or more.
+func MatchTopic(pattern string, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern []string, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// routes reports whether an exchange of kind delivers key to a queue bound
+// with patterns. A fanout, or a queue bound without patterns, gets everything.
+func routes(kind string, patterns []string, key string) bool {
+	if kind != TOPIC || len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if MatchTopic(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
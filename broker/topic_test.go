@@ -0,0 +1,52 @@
+package broker
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"metric.login", "metric.login", true},
+		{"metric.login", "metric.logout", false},
+		{"metric.*", "metric.login", true},
+		{"metric.*", "metric", false},
+		{"metric.*", "metric.login.3", false},
+		{"metric.*.3", "metric.login.3", true},
+		{"metric.#", "metric", true},
+		{"metric.#", "metric.login.3", true},
+		{"#", "", true},
+		{"#", "metric.login", true},
+		{"#.3", "metric.login.3", true},
+		{"#.3", "metric.login.4", false},
+		{"metric.#.3", "metric.3", true},
+		{"*", "", true},
+		{"*", "a.b", false},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.key); got != c.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	cases := []struct {
+		kind     string
+		patterns []string
+		key      string
+		want     bool
+	}{
+		{FANOUT, []string{"metric.login"}, "metric.logout", true},
+		{TOPIC, nil, "metric.logout", true},
+		{TOPIC, []string{"metric.login"}, "metric.logout", false},
+		{TOPIC, []string{"metric.login", "metric.logout"}, "metric.logout", true},
+		{TOPIC, []string{"metric.*.1"}, "metric.login.1", true},
+	}
+	for _, c := range cases {
+		if got := routes(c.kind, c.patterns, c.key); got != c.want {
+			t.Errorf("routes(%s, %v, %q) = %v, want %v", c.kind, c.patterns, c.key, got, c.want)
+		}
+	}
+}
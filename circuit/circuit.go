@@ -0,0 +1,158 @@
+package circuit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+const (
+	CLOSED    = "closed"
+	OPEN      = "open"
+	HALF_OPEN = "half-open"
+
+	DEFAULT_THRESHOLD = 5
+	DEFAULT_COOLDOWN  = 10 * time.Second
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker guards the calls to a store. Threshold failures in a row open it;
+// while open the worker stops consuming instead of failing every delivery.
+// Every Cooldown it goes half-open and runs Probe, closing again once the
+// probe succeeds.
+type Breaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+	Probe     func() error
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	since    time.Time
+	lastErr  error
+	closed   chan bool
+}
+
+func New(name string, threshold int, cooldown time.Duration, probe func() error) *Breaker {
+	if threshold < 1 {
+		threshold = DEFAULT_THRESHOLD
+	}
+	if cooldown <= 0 {
+		cooldown = DEFAULT_COOLDOWN
+	}
+	return &Breaker{
+		Name:      name,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		Probe:     probe,
+		state:     CLOSED,
+		since:     time.Now().UTC(),
+	}
+}
+
+// Allow reports whether calls should go to the store.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == CLOSED
+}
+
+// Record counts the outcome of a call and reports whether it opened the
+// breaker, which the caller should answer by pausing its consumer. Only
+// RETRYABLE errors are failures; the others came from a store that answered.
+func (b *Breaker) Record(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if fault.Class(err) != fault.RETRYABLE {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state != CLOSED || b.failures < b.Threshold {
+		return false
+	}
+	b.set(OPEN)
+	b.closed = make(chan bool)
+	logger.Errorf("Opened the %s breaker after %d failures. ERR: %+v", b.Name, b.failures, err)
+	go b.probe(b.closed)
+	return true
+}
+
+// Wait blocks while the breaker is open.
+func (b *Breaker) Wait() {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed != nil {
+		<-closed
+	}
+}
+
+func (b *Breaker) probe(closed chan bool) {
+	for {
+		time.Sleep(b.Cooldown)
+		b.mu.Lock()
+		b.set(HALF_OPEN)
+		b.mu.Unlock()
+
+		err := b.Probe()
+
+		b.mu.Lock()
+		if err == nil {
+			b.set(CLOSED)
+			b.failures = 0
+			b.closed = nil
+			b.mu.Unlock()
+			close(closed)
+			logger.Infof("Closed the %s breaker", b.Name)
+			return
+		}
+		b.lastErr = err
+		b.set(OPEN)
+		b.mu.Unlock()
+		logger.Errorf("The %s breaker stays open. ERR: %+v", b.Name, err)
+	}
+}
+
+func (b *Breaker) set(state string) {
+	if b.state != state {
+		b.state = state
+		b.since = time.Now().UTC()
+	}
+}
+
+// Status is the state of a breaker as the health output shows it.
+type Status struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := Status{Name: b.Name, State: b.state, Since: b.since, Failures: b.failures}
+	if b.lastErr != nil && b.state != CLOSED {
+		s.Error = b.lastErr.Error()
+	}
+	return s
+}
+
+// Configured is a registered Breaker with the breaker-failures and
+// breaker-cooldown-ms options.
+func Configured(conf *config.Config, name string, probe func() error) *Breaker {
+	threshold, _ := conf.Int(conf.Env, "breaker-failures")
+	cooldown, _ := conf.Int(conf.Env, "breaker-cooldown-ms")
+	b := New(name, threshold, time.Duration(cooldown)*time.Millisecond, probe)
+	Register(b)
+	return b
+}
@@ -0,0 +1,108 @@
+package circuit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/fault"
+)
+
+var errDown = errors.New("store is down")
+
+func TestRecord(t *testing.T) {
+	cases := []struct {
+		name    string
+		errs    []error
+		opened  int
+		allowed bool
+	}{
+		{"successes", []error{nil, nil, nil}, -1, true},
+		{"below threshold", []error{errDown, errDown}, -1, true},
+		{"threshold", []error{errDown, errDown, errDown}, 2, false},
+		{"opened once", []error{errDown, errDown, errDown, errDown}, 2, false},
+		{"success resets", []error{errDown, errDown, nil, errDown, errDown}, -1, true},
+		{"permanent resets", []error{errDown, errDown, fault.Permanent(errDown), errDown}, -1, true},
+		{"poison resets", []error{errDown, errDown, fault.Poison(errDown), errDown}, -1, true},
+		{"retryable counts", []error{fault.Retryable(errDown), errDown, errDown}, 2, false},
+	}
+	for _, c := range cases {
+		b := New("store", 3, time.Hour, func() error { return errDown })
+		for i, err := range c.errs {
+			if opened := b.Record(err); opened != (i == c.opened) {
+				t.Errorf("%s: Record #%d opened %v", c.name, i, opened)
+			}
+		}
+		if got := b.Allow(); got != c.allowed {
+			t.Errorf("%s: Allow() = %v, want %v", c.name, got, c.allowed)
+		}
+		want := CLOSED
+		if !c.allowed {
+			want = OPEN
+		}
+		if got := b.Status().State; got != want {
+			t.Errorf("%s: state %s, want %s", c.name, got, want)
+		}
+	}
+}
+
+// An open breaker probes every cooldown, going half-open meanwhile, and
+// closes once a probe succeeds.
+func TestProbe(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		probes int
+		states []string
+	)
+	var b *Breaker
+	b = New("store", 1, 10*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		probes++
+		states = append(states, b.Status().State)
+		if probes < 3 {
+			return errDown
+		}
+		return nil
+	})
+	if !b.Record(errDown) {
+		t.Fatal("a failure at threshold 1 did not open the breaker")
+	}
+	if s := b.Status(); s.State != OPEN || s.Error != errDown.Error() || s.Failures != 1 {
+		t.Errorf("status %+v, want open with the failure", s)
+	}
+
+	waited := make(chan bool)
+	go func() {
+		b.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return once the probe succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if probes != 3 {
+		t.Errorf("probed %d times, want 3", probes)
+	}
+	for i, state := range states {
+		if state != HALF_OPEN {
+			t.Errorf("probe %d ran %s, want %s", i, state, HALF_OPEN)
+		}
+	}
+	if s := b.Status(); s.State != CLOSED || s.Error != "" || s.Failures != 0 || !b.Allow() {
+		t.Errorf("status %+v, want closed", s)
+	}
+}
+
+func TestWaitWhileClosed(t *testing.T) {
+	b := New("store", 0, 0, nil)
+	if b.Threshold != DEFAULT_THRESHOLD || b.Cooldown != DEFAULT_COOLDOWN {
+		t.Errorf("defaults %d %s, want %d %s", b.Threshold, b.Cooldown, DEFAULT_THRESHOLD, DEFAULT_COOLDOWN)
+	}
+	b.Wait()
+}
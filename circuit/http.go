@@ -0,0 +1,52 @@
+package circuit
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/arvindram03/asynch-workers/config"
+)
+
+var registry = struct {
+	sync.Mutex
+	breakers map[string]*Breaker
+}{breakers: map[string]*Breaker{}}
+
+// Register adds b to the health output.
+func Register(b *Breaker) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.breakers[b.Name] = b
+}
+
+// Health serves GET /health, the state of every registered breaker. It
+// answers 503 while one is not closed.
+var Health = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	registry.Lock()
+	var names []string
+	for name := range registry.breakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	statuses := []Status{}
+	healthy := true
+	for _, name := range names {
+		s := registry.breakers[name].Status()
+		s.Error = config.Redact(s.Error)
+		healthy = healthy && s.State == CLOSED
+		statuses = append(statuses, s)
+	}
+	registry.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"healthy": healthy, "breakers": statuses})
+})
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	robfig "github.com/robfig/config"
+)
+
+const (
+	DEFAULT_ENV  = "DEV"
+	DEFAULT_FILE = "app.conf"
+
+	ENV_VARIABLE    = "APP_ENV"
+	CONFIG_VARIABLE = "APP_CONFIG"
+)
+
+var (
+	envFlag  = flag.String("env", "", "section of app.conf to use (default $"+ENV_VARIABLE+" or "+DEFAULT_ENV+")")
+	pathFlag = flag.String("config", "", "path of app.conf (default $"+CONFIG_VARIABLE+", ./app.conf or ../app.conf)")
+)
+
+// Config reads options from one section of app.conf. Every option can be
+// overridden by an environment variable named after it, e.g. RABBITMQ_URL
+// for rabbitmq-url, and any value may point at a secret with "file:<path>"
+// or "env:<NAME>".
+type Config struct {
+	*robfig.Config
+	Env      string
+	Path     string
+	Required []string
+}
+
+// Load reads app.conf after flag.Parse and fails if any of the required
+// options is missing from the selected section.
+func Load(required ...string) (*Config, error) {
+	env := firstOf(*envFlag, os.Getenv(ENV_VARIABLE), DEFAULT_ENV)
+	path := firstOf(*pathFlag, os.Getenv(CONFIG_VARIABLE))
+	if path == "" {
+		path = DEFAULT_FILE
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = "../" + DEFAULT_FILE
+		}
+	}
+	return read(path, env, required)
+}
+
+func read(path string, env string, required []string) (*Config, error) {
+	conf, err := robfig.ReadDefault(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if !conf.HasSection(env) {
+		return nil, fmt.Errorf("%s has no [%s] section", path, env)
+	}
+
+	c := &Config{Config: conf, Env: env, Path: path, Required: required}
+	var missing []string
+	for _, option := range required {
+		_, err := c.String(env, option)
+		if err != nil && conf.HasOption(env, option) {
+			return nil, fmt.Errorf("resolving %s: %v", option, err)
+		}
+		if err != nil {
+			missing = append(missing, option)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("[%s] in %s is missing %s", env, path, strings.Join(missing, ", "))
+	}
+	return c, nil
+}
+
+// EnvName is the environment variable overriding an option.
+func EnvName(option string) string {
+	return strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+func (c *Config) String(section string, option string) (string, error) {
+	if value, ok := os.LookupEnv(EnvName(option)); ok {
+		return resolve(value)
+	}
+	value, err := c.Config.String(section, option)
+	if err != nil {
+		return "", err
+	}
+	return resolve(value)
+}
+
+func (c *Config) Int(section string, option string) (int, error) {
+	value, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// AtLeast checks that each of options that is set is an integer no smaller
+// than min.
+func (c *Config) AtLeast(min int, options ...string) error {
+	for _, option := range options {
+		if _, err := c.String(c.Env, option); err != nil && !c.HasOption(c.Env, option) {
+			continue
+		}
+		value, err := c.Int(c.Env, option)
+		if err != nil {
+			return fmt.Errorf("%s: %v", option, err)
+		}
+		if value < min {
+			return fmt.Errorf("%s is %d, it must be at least %d", option, value, min)
+		}
+	}
+	return nil
+}
+
+func (c *Config) Bool(section string, option string) (bool, error) {
+	value, err := c.String(section, option)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(value) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("could not parse bool value: %s", value)
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+// Reloader re-reads app.conf on SIGHUP and, when Poll is positive, whenever
+// the modification time of the file or of a secret file it points at
+// changes. A config that fails validation is ignored. Otherwise Apply
+// receives it along with the options that changed; options missing from
+// Live and from OnChange only take effect after a restart. Validate, when
+// set, rejects a config whose live options do not parse before anything is
+// applied.
+type Reloader struct {
+	Live     []string
+	Poll     time.Duration
+	Validate func(next *Config) error
+	Apply    func(next *Config, changed []string)
+
+	// values are the resolved options of the current config. Secrets
+	// resolve to their latest value, so a rotation only shows against
+	// these.
+	values map[string]string
+}
+
+// onChange are the callbacks OnChange registered.
+var (
+	onChangeMx sync.Mutex
+	onChange   []*changeHook
+)
+
+// changeHook remembers the values its options had when last applied, so
+// that the Reloaders of a process running several workers apply a change
+// once.
+type changeHook struct {
+	options []string
+	values  map[string]string
+	apply   func(next *Config, changed []string)
+}
+
+// OnChange has every Reloader treat options as live and call apply with the
+// ones a reload changed from their values in current. It is for connections
+// made outside of the Reloader's owner, like a worker's broker.
+func OnChange(current *Config, apply func(next *Config, changed []string), options ...string) {
+	onChangeMx.Lock()
+	defer onChangeMx.Unlock()
+	onChange = append(onChange, &changeHook{options: options, values: resolvedOptions(current, options), apply: apply})
+}
+
+// applyHooks runs the hooks whose options next changes.
+func applyHooks(next *Config) {
+	onChangeMx.Lock()
+	var due []*changeHook
+	var changes [][]string
+	for _, hook := range onChange {
+		values := resolvedOptions(next, hook.options)
+		if changed := changedOptions(hook.values, values); len(changed) > 0 {
+			hook.values = values
+			due = append(due, hook)
+			changes = append(changes, changed)
+		}
+	}
+	onChangeMx.Unlock()
+	for i, hook := range due {
+		hook.apply(next, changes[i])
+	}
+}
+
+func hookOptions() []string {
+	onChangeMx.Lock()
+	defer onChangeMx.Unlock()
+	var options []string
+	for _, hook := range onChange {
+		options = append(options, hook.options...)
+	}
+	return options
+}
+
+// Changed lists the options that are among changed.
+func Changed(changed []string, options ...string) []string {
+	var among []string
+	for _, option := range options {
+		for _, c := range changed {
+			if c == option {
+				among = append(among, option)
+				break
+			}
+		}
+	}
+	return among
+}
+
+// NewReloader polls c's file every config-watch-interval-s seconds, or only
+// on SIGHUP when that is unset or 0.
+func NewReloader(c *Config, live ...string) *Reloader {
+	seconds, _ := c.Int(c.Env, "config-watch-interval-s")
+	return &Reloader{Live: live, Poll: time.Duration(seconds) * time.Second}
+}
+
+// Start watches for reloads of current in the background.
+func (r *Reloader) Start(current *Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var poll <-chan time.Time
+	if r.Poll > 0 {
+		poll = time.Tick(r.Poll)
+	}
+	modTime := modTimes(current.Path)
+	r.values = resolved(current)
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				logger.Infof("Received SIGHUP, reloading %s", current.Path)
+			case <-poll:
+				latest := modTimes(current.Path)
+				if latest == modTime {
+					continue
+				}
+				modTime = latest
+				logger.Infof("%s changed, reloading", current.Path)
+			}
+			if next := r.reload(current); next != nil {
+				current = next
+			}
+		}
+	}()
+}
+
+func (r *Reloader) reload(current *Config) *Config {
+	next, err := read(current.Path, current.Env, current.Required)
+	if err != nil {
+		logger.Errorf("Keeping the current config, reload failed. ERR: %s", Redact(err.Error()))
+		return nil
+	}
+	if r.Validate != nil {
+		if err := r.Validate(next); err != nil {
+			logger.Errorf("Keeping the current config, reload is invalid. ERR: %s", Redact(err.Error()))
+			return nil
+		}
+	}
+	values := resolved(next)
+	changed := changedOptions(r.values, values)
+	r.values = values
+	if len(changed) == 0 {
+		logger.Infof("Config unchanged")
+		return next
+	}
+
+	live := map[string]bool{}
+	for _, option := range append(hookOptions(), r.Live...) {
+		live[option] = true
+	}
+	var applied, restart []string
+	for _, option := range changed {
+		if live[option] {
+			applied = append(applied, option)
+		} else {
+			restart = append(restart, option)
+		}
+	}
+	if len(applied) > 0 {
+		logger.Infof("Applying %s", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		logger.Infof("Changes to %s need a restart", strings.Join(restart, ", "))
+	}
+	if r.Apply != nil {
+		r.Apply(next, Changed(applied, r.Live...))
+	}
+	applyHooks(next)
+	return next
+}
+
+// resolved reads every option of the selected section.
+func resolved(c *Config) map[string]string {
+	names, _ := c.Options(c.Env)
+	return resolvedOptions(c, names)
+}
+
+// resolvedOptions reads names, an unresolvable one as its error.
+func resolvedOptions(c *Config, names []string) map[string]string {
+	values := map[string]string{}
+	for _, name := range names {
+		value, err := c.String(c.Env, name)
+		if err != nil {
+			value = "\x00" + err.Error()
+		}
+		values[name] = value
+	}
+	return values
+}
+
+// changedOptions lists the options whose resolved values differ.
+func changedOptions(before map[string]string, after map[string]string) []string {
+	var changed []string
+	for option, value := range before {
+		if next, ok := after[option]; !ok || next != value {
+			changed = append(changed, option)
+		}
+	}
+	for option := range after {
+		if _, ok := before[option]; !ok {
+			changed = append(changed, option)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// modTimes stamps the file and the secret files read so far.
+func modTimes(path string) string {
+	stamps := []string{fileModTime(path).String()}
+	for _, secret := range secretFiles() {
+		stamps = append(stamps, fileModTime(secret).String())
+	}
+	return strings.Join(stamps, ",")
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
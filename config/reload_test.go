@@ -0,0 +1,71 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A rotated secret reaches the OnChange hook of its option once, however
+// many Reloaders the process runs, and only the owner's live options reach
+// Apply.
+func TestReloadRotatedSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "postgres-url")
+	if err := ioutil.WriteFile(secret, []byte("postgres://app:old@db/metrics"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "app.conf")
+	conf := "[DEV]\npostgres-url: file:" + secret + "\naccount-handlers: 2\n"
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	current, err := read(path, "DEV", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(hooks []*changeHook) { onChange = hooks }(onChange)
+	onChange = nil
+	var hooked [][]string
+	OnChange(current, func(next *Config, changed []string) {
+		hooked = append(hooked, changed)
+	}, "postgres-url")
+
+	var applied [][]string
+	var reloaders []*Reloader
+	for i := 0; i < 2; i++ {
+		r := &Reloader{Live: []string{"account-handlers"}, values: resolved(current)}
+		r.Apply = func(next *Config, changed []string) {
+			applied = append(applied, changed)
+		}
+		reloaders = append(reloaders, r)
+	}
+
+	if err := ioutil.WriteFile(secret, []byte("postgres://app:new@db/metrics"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(secret, later, later); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reloaders {
+		if r.reload(current) == nil {
+			t.Fatal("reload failed")
+		}
+	}
+
+	if want := [][]string{{"postgres-url"}}; !reflect.DeepEqual(hooked, want) {
+		t.Errorf("hook called with %v, want %v", hooked, want)
+	}
+	if want := [][]string{nil, nil}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("Apply called with %v, want no live option of the owners", applied)
+	}
+}
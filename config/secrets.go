@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_PREFIX = "file:"
+	ENV_PREFIX  = "env:"
+
+	MASK = "****"
+)
+
+type secretFile struct {
+	modTime time.Time
+	value   string
+}
+
+var (
+	secretsMx sync.Mutex
+	files     = map[string]*secretFile{}
+	secrets   = map[string]bool{}
+
+	urlPassword = regexp.MustCompile(`(\w+://[^:/@\s]*:)[^@\s]*@`)
+	dsnPassword = regexp.MustCompile(`(?i)(password=)('[^']*'|\S*)`)
+)
+
+// resolve follows "file:<path>" and "env:<NAME>" indirections. Files are
+// re-read whenever they change so rotated secrets are picked up by the next
+// lookup.
+func resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, FILE_PREFIX):
+		return readSecretFile(strings.TrimPrefix(value, FILE_PREFIX))
+	case strings.HasPrefix(value, ENV_PREFIX):
+		name := strings.TrimPrefix(value, ENV_PREFIX)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s is not set", name)
+		}
+		register(secret)
+		return secret, nil
+	}
+	return value, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	secretsMx.Lock()
+	cached, ok := files[path]
+	secretsMx.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.value, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(content))
+	secretsMx.Lock()
+	files[path] = &secretFile{modTime: info.ModTime(), value: value}
+	secretsMx.Unlock()
+	register(value)
+	return value, nil
+}
+
+// secretFiles lists the secret files read so far.
+func secretFiles() []string {
+	secretsMx.Lock()
+	defer secretsMx.Unlock()
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func register(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMx.Lock()
+	secrets[secret] = true
+	secretsMx.Unlock()
+}
+
+// Redact masks passwords in URLs and key/value DSNs, and every secret read
+// through a file: or env: indirection, so s can be logged.
+func Redact(s string) string {
+	secretsMx.Lock()
+	known := make([]string, 0, len(secrets))
+	for secret := range secrets {
+		known = append(known, secret)
+	}
+	secretsMx.Unlock()
+	// Longer secrets first so one containing another is masked whole.
+	sort.Sort(byLength(known))
+	for _, secret := range known {
+		s = strings.Replace(s, secret, MASK, -1)
+	}
+	s = urlPassword.ReplaceAllString(s, "${1}"+MASK+"@")
+	return dsnPassword.ReplaceAllString(s, "${1}"+MASK)
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Redacted renders the options of the selected section for logging.
+func (c *Config) Redacted() string {
+	options, _ := c.Options(c.Env)
+	sort.Strings(options)
+	lines := make([]string, 0, len(options))
+	for _, option := range options {
+		value, err := c.String(c.Env, option)
+		if err != nil {
+			value = "<" + err.Error() + ">"
+		}
+		if isSecretOption(option) {
+			value = MASK
+		}
+		lines = append(lines, option+": "+Redact(value))
+	}
+	return "[" + c.Env + "] " + strings.Join(lines, ", ")
+}
+
+func isSecretOption(option string) bool {
+	option = strings.ToLower(option)
+	return strings.Contains(option, "password") || strings.Contains(option, "secret") || strings.Contains(option, "token")
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// Settings are the options shared by the server and the workers.
+type Settings struct {
+	RabbitMQURL   string
+	Exchange      string
+	ExchangeType  string
+	RoutingShards int
+	NameQ         string
+	LogQ          string
+	AccQ          string
+
+	// Binding patterns of the queues on a topic exchange.
+	NameQBindings []string
+	LogQBindings  []string
+	AccQBindings  []string
+
+	// Prefetch caps the unacked deliveries of each consumer, 0 is unlimited.
+	Prefetch int
+	// OrderByUsername has the handler pools handle the metrics of a
+	// username one at a time, in order.
+	OrderByUsername bool
+
+	PostgresURL string
+
+	MongoURL            string
+	MongoDBName         string
+	MongoCollectionName string
+
+	RetryCount int
+}
+
+// Settings reads the shared options of the selected section. Options a
+// binary does not use may be empty; Load validates the ones it needs.
+func (c *Config) Settings() Settings {
+	s := Settings{}
+	s.RabbitMQURL, _ = c.String(c.Env, "rabbitmq-url")
+	s.Exchange, _ = c.String(c.Env, "exchange")
+	s.ExchangeType, _ = c.String(c.Env, "exchange-type")
+	s.RoutingShards, _ = c.Int(c.Env, "routing-shards")
+	s.NameQ, _ = c.String(c.Env, "nameq")
+	s.LogQ, _ = c.String(c.Env, "logq")
+	s.AccQ, _ = c.String(c.Env, "accq")
+	s.NameQBindings = c.list("nameq-bindings")
+	s.LogQBindings = c.list("logq-bindings")
+	s.AccQBindings = c.list("accq-bindings")
+	s.Prefetch, _ = c.Int(c.Env, "prefetch")
+	s.OrderByUsername, _ = c.Bool(c.Env, "order-by-username")
+	s.PostgresURL, _ = c.String(c.Env, "postgres-url")
+	s.MongoURL, _ = c.String(c.Env, "mongo-url")
+	s.MongoDBName, _ = c.String(c.Env, "mongo-db-name")
+	s.MongoCollectionName, _ = c.String(c.Env, "mongo-collection-name")
+	s.RetryCount, _ = c.Int(c.Env, "retry-count")
+	return s
+}
+
+// Adaptive are the options of the adaptive concurrency of the workers.
+type Adaptive struct {
+	On                 bool
+	MinHandlers        int
+	MaxHandlers        int
+	TargetLatency      time.Duration
+	Interval           time.Duration
+	PrefetchPerHandler int
+}
+
+func (c *Config) Adaptive() Adaptive {
+	a := Adaptive{}
+	a.On, _ = c.Bool(c.Env, "adaptive")
+	a.MinHandlers, _ = c.Int(c.Env, "adaptive-min-handlers")
+	a.MaxHandlers, _ = c.Int(c.Env, "adaptive-max-handlers")
+	latency, _ := c.Int(c.Env, "adaptive-target-latency-ms")
+	a.TargetLatency = time.Duration(latency) * time.Millisecond
+	interval, _ := c.Int(c.Env, "adaptive-interval-ms")
+	a.Interval = time.Duration(interval) * time.Millisecond
+	a.PrefetchPerHandler, _ = c.Int(c.Env, "adaptive-prefetch-per-handler")
+	return a
+}
+
+// list reads a comma separated option, nil when unset.
+func (c *Config) list(option string) []string {
+	value, _ := c.String(c.Env, option)
+	return SplitList(value)
+}
+
+// SplitList splits a comma separated list, dropping blank items.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
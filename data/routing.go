@@ -0,0 +1,42 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const ROUTING_PREFIX = "metric"
+
+// RoutingKey is the topic a metric is published under:
+// metric.<name>.<shard>, where the shard spreads usernames over shards
+// buckets. Dots in the name would add topic words, so they become
+// underscores.
+func (m Metric) RoutingKey(shards int) string {
+	name := strings.Replace(m.Metric, ".", "_", -1)
+	if name == "" {
+		name = "_"
+	}
+	return fmt.Sprintf("%s.%s.%d", ROUTING_PREFIX, name, UsernameShard(m.Username, shards))
+}
+
+// UsernameShard buckets a username into one of shards.
+func UsernameShard(username string, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Username reads the username of a published metric, "" when body is not
+// one.
+func Username(body []byte) string {
+	var m struct {
+		Username string `json:"username"`
+	}
+	json.Unmarshal(body, &m)
+	return m.Username
+}
@@ -0,0 +1,90 @@
+package event_aggregator
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+const (
+	CURATE_COMMAND = "curate"
+	MONTH_LAYOUT   = "2006-01"
+)
+
+// runCurateCommand re-runs curation for a month or a range of months:
+//
+//	asynch-workers curate -from 2015-01 [-to 2015-03] [-apply]
+//
+// Without -apply it only reports the keys that would be merged and deleted.
+func runCurateCommand(args []string) {
+	fs := flag.NewFlagSet(CURATE_COMMAND, flag.ExitOnError)
+	from := fs.String("from", "", "first month to curate (YYYY-MM)")
+	to := fs.String("to", "", "last month to curate (YYYY-MM), defaults to -from")
+	apply := fs.Bool("apply", false, "write summaries and delete keys instead of a dry run")
+	fs.Parse(args)
+
+	start, err := time.Parse(MONTH_LAYOUT, *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "curate: -from must be a month formatted YYYY-MM")
+		fs.Usage()
+		os.Exit(2)
+	}
+	end := start
+	if *to != "" {
+		end, err = time.Parse(MONTH_LAYOUT, *to)
+		if err != nil || end.Before(start) {
+			fmt.Fprintln(os.Stderr, "curate: -to must be a month formatted YYYY-MM, not before -from")
+			os.Exit(2)
+		}
+	}
+
+	client := Redis
+	if !acquireLock(client) {
+		logger.Fatalf("Curation lock is held by another process")
+	}
+	defer releaseLock(client)
+
+	for month := start; !month.After(end); month = month.AddDate(0, 1, 0) {
+		c, err := planCuration(client, month.Year(), int(month.Month()))
+		if err != nil {
+			logger.Fatalf("Failed to plan curation of %s. ERR: %+v", month.Format(MONTH_LAYOUT), err)
+		}
+		report(c, *apply)
+		if !*apply {
+			continue
+		}
+		if err := c.apply(client); err != nil {
+			logger.Fatalf("Failed to curate %s. ERR: %+v", c.YearMonth, err)
+		}
+	}
+}
+
+func report(c *curation, apply bool) {
+	if len(c.EventKeys) == 0 {
+		fmt.Printf("%s: nothing to curate\n", c.YearMonth)
+		return
+	}
+	verb := "would"
+	if apply {
+		verb = "will"
+	}
+	action := "write"
+	if c.Merged {
+		action = "merge into"
+	}
+	fmt.Printf("%s: %s %s summary %s (%d events)\n", c.YearMonth, verb, action, c.YearMonth, len(c.Summary.Events))
+	for metric, summary := range c.Summary.Metrics {
+		fmt.Printf("  %s: count %d, users %d, days %d\n", metric, summary.Count, summary.Users, len(summary.Days))
+	}
+	fmt.Printf("  %s delete %d keys:\n", verb, len(c.EventKeys)+len(c.CounterKeys)+1)
+	for _, key := range c.EventKeys {
+		fmt.Println("   ", key)
+	}
+	for _, key := range c.CounterKeys {
+		fmt.Println("   ", key)
+	}
+	fmt.Println("   ", c.Index)
+}
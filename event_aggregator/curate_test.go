@@ -0,0 +1,25 @@
+package event_aggregator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCuratedMonth(t *testing.T) {
+	cases := []struct {
+		scheduled time.Time
+		year      int
+		month     int
+	}{
+		{time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), 2016, 2},
+		{time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC), 2016, 2},
+		{time.Date(2016, 3, 31, 23, 59, 0, 0, time.UTC), 2016, 2},
+		{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), 2015, 12},
+		{time.Date(2016, 3, 1, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), 2016, 1},
+	}
+	for _, c := range cases {
+		if year, month := curatedMonth(c.scheduled); year != c.year || month != c.month {
+			t.Errorf("curatedMonth(%s) = %d-%02d, want %d-%02d", c.scheduled, year, month, c.year, c.month)
+		}
+	}
+}
@@ -1,260 +1,328 @@
-package main
+package event_aggregator
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
-	"strconv"
+	"errors"
 	"strings"
 	"time"
 
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/config"
 	"github.com/arvindram03/asynch-workers/data"
-	"github.com/arvindram03/asynch-workers/rabbitmq"
-	"github.com/robfig/config"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/leaderboard"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/pool"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/arvindram03/asynch-workers/scheduler"
+	"github.com/streadway/amqp"
 	redis "gopkg.in/redis.v3"
 )
 
 const (
-	DIST_LOCK = "DIST_LOCK"
-	ACQUIRED  = 1
+	DIST_LOCK  = "DIST_LOCK"
+	LOCK_TTL   = time.Hour
+	CURATE_JOB = "curate-logs"
 )
 
 var (
-	Config *config.Config
-	ENV    string
+	Config   *config.Config
+	ENV      string
+	Settings config.Settings
+	// Redis is redialed when a reload changes the redis options.
+	Redis *redisclient.Swappable
+
+	curationLock = redisclient.NewLock(DIST_LOCK, LOCK_TTL)
+
+	// ErrLocked fails a scheduled curation while another process holds the
+	// lock, so the month is retried rather than recorded as curated.
+	ErrLocked = errors.New("curation lock is held")
+
+	// Required lists the options the worker cannot start without.
+	Required = []string{"exchange", "nameq", "curate-schedule"}
 )
 
-func loadConfig() (err error) {
-	Config, err = config.ReadDefault("../app.conf")
-	if err != nil {
-		log.Fatalf("Failed to read configs. ERR: %+v", err)
-	}
-	return err
+func setConfig(conf *config.Config) {
+	Config = conf
+	ENV = conf.Env
+	Settings = conf.Settings()
 }
 
-func setENV() {
-	ENV = "DEV"
+func initRedisClient() {
+	client, err := redisclient.New(Config, ENV)
+	if err != nil {
+		logger.Fatalf("Failed to configure redis. ERR: %s", config.Redact(err.Error()))
+	}
+	Redis = redisclient.NewSwappable(client)
 }
 
-func initRedisClient() *redis.Client {
-	redisUrl, _ := Config.String(ENV, "redis-url")
-	return redis.NewClient(&redis.Options{
-		Addr:     redisUrl,
-		Password: "",
-		DB:       0,
-	})
+// curation is what aggregating a month writes and deletes.
+type curation struct {
+	YearMonth   string
+	Index       string
+	EventKeys   []string
+	CounterKeys []string
+	Summary     *MonthlySummary
+	Merged      bool
 }
 
-func getEvents(keys []string) (events []string) {
-	for _, key := range keys {
-		parts := strings.Split(key, " ")
-		if len(parts) != 2 {
-			continue
-		}
-		event := parts[1]
-		events = append(events, event)
+func planCuration(client redisclient.Commands, year int, month int) (*curation, error) {
+	c := &curation{YearMonth: monthKey(year, month), Index: indexKey(year, month)}
+	keys, err := indexedKeys(client, c.Index)
+	if err != nil {
+		logger.Errorf("Failed to read the monthly event index. ERR: %+v", err)
+		return nil, err
+	}
+	c.EventKeys = keys
+	if len(keys) == 0 {
+		return c, nil
 	}
-	return
-}
 
-func aggregate(client *redis.Client, year int, month int) error {
-	log.Println("Curating logs...")
-	yearMonth := strconv.Itoa(year) + "-" + strconv.Itoa(month)
-	key := yearMonth + "-*"
-	keys, err := client.Keys(key).Result()
+	c.Summary, c.CounterKeys, err = summarize(client, c.YearMonth, keys)
 	if err != nil {
-		log.Printf("Failed to set metric connection. ERR: %+v", err)
-		return err
+		logger.Errorf("Failed to summarize the month. ERR: %+v", err)
+		return nil, err
 	}
 
-	if len(keys) == 0 {
-		return nil
+	// A month curated before may have received late events; fold the
+	// existing document in rather than overwriting it.
+	existing, err := client.Get(c.YearMonth).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
-
-	events := getEvents(keys)
-	monthlyEvent := struct {
-		Events []string
-	}{
-		events,
+	if err == nil {
+		var previous MonthlySummary
+		if err := json.Unmarshal(existing, &previous); err != nil {
+			logger.Errorf("Failed to read the existing summary. ERR: %+v", err)
+			return nil, err
+		}
+		mergeSummary(c.Summary, &previous)
+		c.Merged = true
 	}
+	return c, nil
+}
 
-	byteContent, err := json.Marshal(monthlyEvent)
+func (c *curation) apply(client redisclient.Commands) error {
+	if len(c.EventKeys) == 0 {
+		return nil
+	}
+	byteContent, err := json.Marshal(c.Summary)
 	if err != nil {
-		log.Println("Failed to set all event under single key. ERR: %+v", err)
+		logger.Errorf("Failed to set all event under single key. ERR: %+v", err)
 		return err
 	}
 
-	err = client.Set(yearMonth, byteContent, 0).Err()
+	err = client.Set(c.YearMonth, byteContent, 0).Err()
 	if err != nil {
-		log.Println("Failed to set all event under single key. ERR: %+v", err)
+		logger.Errorf("Failed to set all event under single key. ERR: %+v", err)
 		return err
 	}
 
+	keys := append(append(c.EventKeys, c.CounterKeys...), c.Index)
 	err = client.Del(keys...).Err()
 	if err != nil {
-		log.Println("Failed to delete all event in the past month. ERR: %+v", err)
+		logger.Errorf("Failed to delete all event in the past month. ERR: %+v", err)
 		return err
 	}
 	return err
 }
 
-func acquireLock(client *redis.Client) bool {
-	_, err := client.Watch(DIST_LOCK)
+func aggregate(client redisclient.Commands, year int, month int) error {
+	logger.Infof("Curating logs...")
+	c, err := planCuration(client, year, month)
 	if err != nil {
-		log.Fatalf("Error watching distributed lock key. ERR: %+v", err)
-		return false
-	}
-	value, err := client.Get(DIST_LOCK).Int64()
-	if err != nil {
-		log.Fatalf("Error getting distributed lock key. ERR: %+v", err)
-		return false
-	}
-	if value == ACQUIRED {
-		return false
+		return err
 	}
-	multi := client.Multi()
-	_, err = multi.Exec(func() error {
-		err := multi.Set(DIST_LOCK, ACQUIRED, 0).Err()
-		if err != nil {
-			log.Fatalf("Error setting distributed lock key. ERR: %+v", err)
-			return err
-		}
-		return nil
-	})
+	return c.apply(client)
+}
+
+func acquireLock(client redisclient.Commands) bool {
+	acquired, err := curationLock.Acquire(client)
 	if err != nil {
-		log.Fatalf("Error executing the set distributed lock key. ERR: %+v", err)
+		logger.Errorf("Error acquiring distributed lock. ERR: %+v", err)
 		return false
 	}
-	return true
+	return acquired
 }
 
-func releaseLock(client *redis.Client) {
-	err := client.Set(DIST_LOCK, 0, 0).Err()
+func releaseLock(client redisclient.Commands) {
+	err := curationLock.Release(client)
 	if err != nil {
-		log.Fatalf("Error in releasing the lock. ERR: %+v", err)
+		logger.Errorf("Error in releasing the lock. ERR: %+v", err)
 	}
 }
 
-func curate() {
-	client := initRedisClient()
-	if !acquireLock(client) {
-		return
-	}
-	fmt.Println("Acquired Lock")
-	year, month, _ := time.Now().UTC().Date()
-	retryCount, _ := Config.Int(ENV, "retry-count")
-	backoff_time := 2 * time.Second
-	for i := 0; i < retryCount; i++ {
-		err := aggregate(client, year, int(month))
-		if err == nil {
-			break
-		}
-		log.Println("Failed to aggregate logs for the month. ERR: %+v", err)
-		backoff_time = backoff_time * 2
-		log.Println("Backing off for", backoff_time)
-		<-time.After(backoff_time)
+func curate(scheduled time.Time) error {
+	if !acquireLock(Redis) {
+		return ErrLocked
 	}
-	releaseLock(client)
-	client.Close()
+	logger.Infof("Acquired the curation lock")
+	defer releaseLock(Redis)
+	year, month := curatedMonth(scheduled)
+	return aggregate(Redis, year, month)
 }
 
-func getEndOfMonth() time.Duration {
-	now := time.Now()
-	return time.Since(time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC))
+// curatedMonth is the month before the one scheduled falls in, the last
+// one to have ended whatever day the schedule fires on.
+func curatedMonth(scheduled time.Time) (int, int) {
+	year, month, _ := scheduled.UTC().Date()
+	previous := time.Date(year, month-1, 1, 0, 0, 0, 0, time.UTC)
+	return previous.Year(), int(previous.Month())
 }
 
-func curateLogs() {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered in f", r)
-			go curateLogs()
+func scheduleCuration() *scheduler.Scheduler {
+	spec, _ := Config.String(ENV, "curate-schedule")
+	schedule, err := scheduler.Parse(spec)
+	if err != nil {
+		logger.Fatalf("Invalid curate-schedule. ERR: %+v", err)
+	}
+	retryCount := Settings.RetryCount
+
+	s := scheduler.New(scheduler.NewRedisStore(Redis))
+	s.Add(&scheduler.Job{
+		Name:     CURATE_JOB,
+		Schedule: schedule,
+		Retry:    scheduler.RetryPolicy{Attempts: retryCount, Backoff: 2 * time.Second},
+		Run:      curate,
+	})
+	s.Start()
+	return s
+}
+
+// watchConfig applies reloaded retry and handler settings and redials Redis.
+func watchConfig(curation *scheduler.Scheduler, handlers *pool.Pool) {
+	reloader := config.NewReloader(Config, append([]string{"retry-count", "event-handlers"}, redisclient.ConnectionOptions...)...)
+	reloader.Validate = func(next *config.Config) error {
+		if err := next.AtLeast(0, "retry-count"); err != nil {
+			return err
 		}
-	}()
-	<-time.After(getEndOfMonth())
-	curate()
-	c := time.Tick(30 * 24 * time.Hour)
-	// c := time.Tick(3 * time.Second)
-	for _ = range c {
-		curate()
+		return next.AtLeast(1, "event-handlers")
 	}
+	reloader.Apply = func(next *config.Config, changed []string) {
+		if len(config.Changed(changed, redisclient.ConnectionOptions...)) > 0 {
+			if err := Redis.Redial(next, ENV); err != nil {
+				logger.Errorf("Failed to redial redis, keeping the current connection. ERR: %s", config.Redact(err.Error()))
+			}
+		}
+		if len(config.Changed(changed, "retry-count", "event-handlers")) == 0 {
+			return
+		}
+		retryCount := next.Settings().RetryCount
+		curation.SetRetry(CURATE_JOB, scheduler.RetryPolicy{Attempts: retryCount, Backoff: 2 * time.Second})
+		size, _ := next.Int(ENV, "event-handlers")
+		if err := handlers.Resize(size); err != nil {
+			logger.Errorf("Failed to resize handlers. ERR: %+v", err)
+		}
+	}
+	reloader.Start(Config)
 }
 
-func process(metric data.Metric, client *redis.Client) error {
-	year, month, day := time.Now().UTC().Date()
-	date := strconv.Itoa(year) + "-" + strconv.Itoa(int(month)) + "-" + strconv.Itoa(day)
-	key := date + " " + metric.Metric
-	err := client.Set(key, true, 0).Err()
+func process(metric data.Metric, client redisclient.Client) error {
+	now := time.Now().UTC()
+	year, month, day := now.Date()
+	key := eventKey(now, metric.Metric)
+	err := client.Pipelined(func(pipe redisclient.Commands) error {
+		pipe.Set(key, true, 0)
+		pipe.SAdd(indexKey(year, int(month)), key)
+		pipe.IncrBy(countKey(dayKey(year, int(month), day), metric.Metric), metric.Count)
+		pipe.IncrBy(countKey(monthKey(year, int(month)), metric.Metric), metric.Count)
+		pipe.PFAdd(usersKey(dayKey(year, int(month), day), metric.Metric), metric.Username)
+		leaderboard.Record(pipe, metric, now)
+		return nil
+	})
+	// A key of another type fails on every retry.
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return fault.Permanent(err)
+	}
 	if err != nil {
-		log.Fatalf("Failed to set metric connection. ERR: %+v", err)
+		return fault.Retryable(err)
 	}
-	log.Printf("Metric %+v", metric)
-	return err
+	return nil
 }
 
-func main() {
-	setENV()
-	loadConfig()
+// Curate runs the curate subcommand with its arguments.
+func Curate(conf *config.Config, args []string) {
+	setConfig(conf)
+	initRedisClient()
+	defer Redis.Close()
+	runCurateCommand(args)
+}
 
-	rabbitmqUrl, _ := Config.String(ENV, "rabbitmq-url")
-	conn, err := rabbitmq.Dial(rabbitmqUrl)
-	if err != nil {
-		log.Fatalf("Failed to get connection. ERR: %+v", err)
+// MigrateKeys rewrites the keys of earlier versions, see migrateKeys.
+func MigrateKeys(conf *config.Config) {
+	setConfig(conf)
+	initRedisClient()
+	defer Redis.Close()
+	if err := migrateKeys(Redis); err != nil {
+		logger.Fatalf("Failed to migrate keys. ERR: %+v", err)
 	}
-	defer conn.Close()
+}
 
-	ch, err := rabbitmq.Channel(conn)
-	if err != nil {
-		log.Fatalf("Failed to open channel. ERR: %+v", err)
+// Run counts events and users per metric until the process exits, and
+// curates every month that ends meanwhile.
+func Run(conf *config.Config, b broker.Broker) {
+	setConfig(conf)
+	initRedisClient()
+	defer Redis.Close()
+
+	store := circuit.Configured(Config, "redis", func() error { return Redis.Ping().Err() })
+
+	size, _ := Config.Int(ENV, "event-handlers")
+	var key func(amqp.Delivery) string
+	if Settings.OrderByUsername {
+		key = func(d amqp.Delivery) string { return data.Username(d.Body) }
 	}
-	defer ch.Close()
-	exchange, _ := Config.String(ENV, "exchange")
-	err = rabbitmq.Exchange(exchange, ch)
-	if err != nil {
-		log.Fatalf("Failed to declare an exchange. ERR: %+v", err)
+	handlers := pool.New(size, key)
+	pool.Register(Settings.NameQ, handlers)
+	if adaptive := Config.Adaptive(); adaptive.On {
+		handlers.Adapt(adaptive, b, Settings.NameQ)
 	}
 
-	nameq, _ := Config.String(ENV, "nameq")
-	q, err := rabbitmq.Queue(nameq, ch)
-	if err != nil {
-		log.Fatalf("Failed to declare a queue. ERR: %+v", err)
-	}
+	forever := make(chan bool)
 
-	err = rabbitmq.QueueBind(q, exchange, ch)
+	deadLetter, _ := Config.String(ENV, "dead-letter-exchange")
+	settler, err := fault.NewSettler(b, Settings.NameQ, deadLetter)
 	if err != nil {
-		log.Fatalf("Failed to bind. ERR: %+v", err)
+		logger.Fatalf("Failed to declare the dead letters of %s. ERR: %s", Settings.NameQ, config.Redact(err.Error()))
 	}
-
-	msgs, err := rabbitmq.Consume(q, ch)
-	if err != nil {
-		log.Fatalf("Failed to register name collector. ERR: %+v", err)
+	handle := func(d amqp.Delivery) {
+		var metric data.Metric
+		if err := json.Unmarshal(d.Body, &metric); err != nil {
+			settler.Settle(d, fault.Poison(err))
+			return
+		}
+		if !store.Allow() {
+			settler.Settle(d, circuit.ErrOpen)
+			return
+		}
+		logger.ForDelivery(Settings.NameQ, d).With(logger.MetricFields(metric.Username, metric.Metric, metric.Count)).Infof("Metric")
+		err := process(metric, Redis)
+		if store.Record(err) {
+			logger.Warnf("Pausing %s", Settings.NameQ)
+			b.Cancel(Settings.NameQ)
+		}
+		settler.Settle(d, err)
 	}
 
-	forever := make(chan bool)
-
+	// Consumption stops while Redis is down and resumes once the breaker
+	// closes.
 	go func() {
-		for d := range msgs {
-			client := initRedisClient()
-			var metric data.Metric
-			err := json.Unmarshal(d.Body, &metric)
-			if err != nil {
-				log.Fatalf("Error unmarshalling metric. ERR: %+v", err)
-			}
-			err = process(metric, client)
+		for {
+			msgs, err := b.Consume(Settings.Exchange, Settings.NameQ, Settings.NameQBindings)
 			if err != nil {
-				d.Nack(true, true)
+				logger.Errorf("Failed to register name collector. ERR: %s", config.Redact(err.Error()))
+				time.Sleep(time.Second)
+				continue
 			}
-			d.Ack(false)
-			client.Close()
+			handlers.Run(msgs, handle)
+			store.Wait()
+			logger.Infof("Resuming %s", Settings.NameQ)
 		}
 	}()
 
-	// // if curator panics, recovers and invoked the curator again after sleeping
-	// // for 10 seconds
-	// go func() {
-
-	// }()
-	go curateLogs()
+	watchConfig(scheduleCuration(), handlers)
 
-	log.Printf("Waiting for metrics....")
+	logger.Infof("Waiting for metrics....")
 	<-forever
 }
@@ -0,0 +1,221 @@
+package event_aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	INDEX_SUFFIX = "events"
+	COUNT_PREFIX = "count:"
+	USERS_PREFIX = "users:"
+	SCAN_COUNT   = 1000
+)
+
+// The merges fold a legacy key into the new one, which a worker of the new
+// version may already be writing to, and drop it in one step so that running
+// the migration again counts nothing twice.
+const (
+	mergeCountScript = `
+local count = redis.call("GET", KEYS[1])
+if count then
+	redis.call("INCRBY", KEYS[2], count)
+	redis.call("DEL", KEYS[1])
+end
+return 1`
+
+	mergeUsersScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("PFMERGE", KEYS[2], KEYS[1])
+	redis.call("DEL", KEYS[1])
+end
+return 1`
+)
+
+var (
+	legacyEventKey   = regexp.MustCompile(`^(\d{4})-(\d{1,2})-(\d{1,2}) (.+)$`)
+	legacyCounterKey = regexp.MustCompile(`^(count:|users:)(\d{4})-(\d{2})(-\d{2})? (.+)$`)
+	legacyIndexKey   = regexp.MustCompile(`^events:\d{4}-\d{2}$`)
+	legacyMonthKey   = regexp.MustCompile(`^(\d{4})-(\d{1,2})$`)
+)
+
+func monthKey(year int, month int) string {
+	return fmt.Sprintf("%04d-%02d", year, month)
+}
+
+func dayKey(year int, month int, day int) string {
+	return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+}
+
+// hashTag prefixes every key of a month with {YYYY-MM} so that, in cluster
+// mode, curation's multi-key commands stay within a single slot.
+func hashTag(period string) string {
+	return "{" + period[:7] + "}:"
+}
+
+func eventKey(t time.Time, metric string) string {
+	year, month, day := t.UTC().Date()
+	date := dayKey(year, int(month), day)
+	return hashTag(date) + date + " " + metric
+}
+
+// parseEventKey splits an event key into its day and metric.
+func parseEventKey(key string) (day string, metric string, ok bool) {
+	if i := strings.Index(key, "}:"); i >= 0 {
+		key = key[i+2:]
+	}
+	parts := strings.SplitN(key, " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// countKey holds the total Count of a metric over a day or month.
+func countKey(period string, metric string) string {
+	return hashTag(period) + COUNT_PREFIX + period + " " + metric
+}
+
+// usersKey is a HyperLogLog of the users who sent a metric during a period.
+func usersKey(period string, metric string) string {
+	return hashTag(period) + USERS_PREFIX + period + " " + metric
+}
+
+// indexKey is the set holding every event key recorded during a month.
+func indexKey(year int, month int) string {
+	return hashTag(monthKey(year, month)) + INDEX_SUFFIX
+}
+
+func indexedKeys(client redisclient.Commands, index string) ([]string, error) {
+	var (
+		cursor int64
+		keys   []string
+	)
+	for {
+		next, page, err := client.SScan(index, cursor, "", SCAN_COUNT).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// migrateKeys rewrites keys written by earlier versions: untagged event keys
+// such as "2015-1-5 metric" become "{2015-01}:2015-01-05 metric" and are added
+// to the index of their month, counters gain the hash tag, untagged indexes
+// are dropped and curated "2015-1" documents become "2015-01". Counters,
+// user counts and documents already written under the new key are merged
+// with the legacy ones rather than overwritten. SCAN only
+// walks a single node, so this refuses to run in cluster mode.
+func migrateKeys(client redisclient.Client) error {
+	if client.Mode() == redisclient.CLUSTER {
+		return fmt.Errorf("migrate the keys before switching redis-mode to %s", redisclient.CLUSTER)
+	}
+	var cursor int64
+	migrated := 0
+	for {
+		next, keys, err := client.Scan(cursor, "*", SCAN_COUNT).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			ok, err := migrateKey(client, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	logger.Infof("Migrated %d keys", migrated)
+	return nil
+}
+
+func migrateKey(client redisclient.Commands, key string) (bool, error) {
+	if parts := legacyEventKey.FindStringSubmatch(key); parts != nil {
+		year, month, day := atoi(parts[1]), atoi(parts[2]), atoi(parts[3])
+		date := dayKey(year, month, day)
+		newKey := hashTag(date) + date + " " + parts[4]
+		if err := client.Rename(key, newKey).Err(); err != nil {
+			return false, err
+		}
+		return true, client.SAdd(indexKey(year, month), newKey).Err()
+	}
+	if parts := legacyCounterKey.FindStringSubmatch(key); parts != nil {
+		period := parts[2] + "-" + parts[3] + parts[4]
+		newKey := hashTag(period) + parts[1] + period + " " + parts[5]
+		script := mergeCountScript
+		if parts[1] == USERS_PREFIX {
+			script = mergeUsersScript
+		}
+		return true, client.Eval(script, []string{key, newKey}, nil).Err()
+	}
+	if legacyIndexKey.MatchString(key) {
+		return true, client.Del(key).Err()
+	}
+	if parts := legacyMonthKey.FindStringSubmatch(key); parts != nil {
+		newKey := monthKey(atoi(parts[1]), atoi(parts[2]))
+		if newKey == key {
+			return false, nil
+		}
+		return true, migrateSummary(client, key, newKey)
+	}
+	return false, nil
+}
+
+// migrateSummary renames a curated document, merging it into the one a newer
+// worker may have curated meanwhile.
+func migrateSummary(client redisclient.Commands, key string, newKey string) error {
+	current, err := client.Get(newKey).Bytes()
+	if err == redis.Nil {
+		return client.Rename(key, newKey).Err()
+	}
+	if err != nil {
+		return err
+	}
+	legacy, err := client.Get(key).Bytes()
+	if err != nil {
+		return err
+	}
+	var summary, previous MonthlySummary
+	if err := json.Unmarshal(current, &summary); err != nil {
+		return fmt.Errorf("decoding %s: %v", newKey, err)
+	}
+	if err := json.Unmarshal(legacy, &previous); err != nil {
+		return fmt.Errorf("decoding %s: %v", key, err)
+	}
+	if summary.Metrics == nil {
+		summary.Metrics = map[string]*MetricSummary{}
+	}
+	mergeSummary(&summary, &previous)
+	merged, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err := client.Set(newKey, merged, 0).Err(); err != nil {
+		return err
+	}
+	return client.Del(key).Err()
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
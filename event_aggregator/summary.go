@@ -0,0 +1,124 @@
+package event_aggregator
+
+import (
+	"sort"
+
+	"github.com/arvindram03/asynch-workers/redisclient"
+	redis "gopkg.in/redis.v3"
+)
+
+type DaySummary struct {
+	Count int64
+	Users int64
+}
+
+type MetricSummary struct {
+	Count int64
+	Users int64
+	Days  map[string]*DaySummary
+}
+
+// MonthlySummary is the curated document stored under YYYY-MM.
+type MonthlySummary struct {
+	Events  []string
+	Metrics map[string]*MetricSummary
+}
+
+// summarize rolls the day counters and HyperLogLogs of the indexed event keys
+// into a MonthlySummary. It also returns the counter keys that curation should
+// delete along with the event keys.
+func summarize(client redisclient.Commands, yearMonth string, keys []string) (*MonthlySummary, []string, error) {
+	summary := &MonthlySummary{Metrics: map[string]*MetricSummary{}}
+	var counterKeys []string
+
+	for _, key := range keys {
+		day, metric, ok := parseEventKey(key)
+		if !ok {
+			continue
+		}
+		count, err := client.Get(countKey(day, metric)).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
+		users, err := client.PFCount(usersKey(day, metric)).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metricSummary, ok := summary.Metrics[metric]
+		if !ok {
+			metricSummary = &MetricSummary{Days: map[string]*DaySummary{}}
+			summary.Metrics[metric] = metricSummary
+			summary.Events = append(summary.Events, metric)
+		}
+		metricSummary.Days[day] = &DaySummary{Count: count, Users: users}
+		counterKeys = append(counterKeys, countKey(day, metric), usersKey(day, metric))
+	}
+
+	for metric, metricSummary := range summary.Metrics {
+		count, err := client.Get(countKey(yearMonth, metric)).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
+		metricSummary.Count = count
+
+		// PFCOUNT over several keys counts their union without writing it,
+		// which keeps dry runs read-only.
+		args := []interface{}{"PFCOUNT"}
+		for day := range metricSummary.Days {
+			args = append(args, usersKey(day, metric))
+		}
+		cmd := redis.NewIntCmd(args...)
+		client.Process(cmd)
+		metricSummary.Users, err = cmd.Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		counterKeys = append(counterKeys, countKey(yearMonth, metric))
+	}
+	sort.Strings(summary.Events)
+
+	return summary, counterKeys, nil
+}
+
+// mergeSummary adds previous into summary. Unique users cannot be unioned
+// once the HyperLogLogs are gone, so the larger estimate is kept.
+func mergeSummary(summary *MonthlySummary, previous *MonthlySummary) {
+	for metric, old := range previous.Metrics {
+		current, ok := summary.Metrics[metric]
+		if !ok {
+			summary.Metrics[metric] = old
+			continue
+		}
+		current.Count += old.Count
+		current.Users = maxInt64(current.Users, old.Users)
+		for day, oldDay := range old.Days {
+			currentDay, ok := current.Days[day]
+			if !ok {
+				current.Days[day] = oldDay
+				continue
+			}
+			currentDay.Count += oldDay.Count
+			currentDay.Users = maxInt64(currentDay.Users, oldDay.Users)
+		}
+	}
+
+	events := map[string]bool{}
+	for _, event := range summary.Events {
+		events[event] = true
+	}
+	for _, event := range previous.Events {
+		if !events[event] {
+			events[event] = true
+			summary.Events = append(summary.Events, event)
+		}
+	}
+	sort.Strings(summary.Events)
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,266 @@
+package export
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/event_aggregator"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	_ "github.com/lib/pq"
+	redis "gopkg.in/redis.v3"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	COMMAND = "export"
+
+	ACCOUNTS = "accounts"
+	EVENTS   = "events"
+	LOGS     = "logs"
+
+	DATE_LAYOUT = "2006-01-02"
+)
+
+var (
+	Config   *config.Config
+	ENV      string
+	Settings config.Settings
+)
+
+// filter narrows an export. Empty lists match everything.
+type filter struct {
+	From      time.Time
+	To        time.Time
+	Usernames []string
+	Metrics   []string
+}
+
+func setConfig(conf *config.Config) {
+	Config = conf
+	ENV = conf.Env
+	Settings = conf.Settings()
+}
+
+// exportAccounts streams accounts created within the range.
+func exportAccounts(f filter, format string, out *bufio.Writer) error {
+	postgresUrl := Settings.PostgresURL
+	db, err := sql.Open("postgres", postgresUrl)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := "SELECT id, name, time FROM accounts WHERE time >= $1 AND time < $2"
+	args := []interface{}{f.From, f.To}
+	if len(f.Usernames) > 0 {
+		placeholders := make([]string, len(f.Usernames))
+		for i, username := range f.Usernames {
+			args = append(args, username)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		query += " AND name IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	writer, err := newRowWriter(format, out, []string{"id", "name", "time"})
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			id      int64
+			name    string
+			created time.Time
+		)
+		if err := rows.Scan(&id, &name, &created); err != nil {
+			return err
+		}
+		if err := writer.Write([]interface{}{id, name, created}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// exportEvents streams the curated summaries of every month in the range, one
+// month in memory at a time. A row with an empty day is the month's total.
+// Summaries are per metric, so usernames cannot filter them.
+func exportEvents(f filter, format string, out *bufio.Writer) error {
+	client, err := redisclient.New(Config, ENV)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	writer, err := newRowWriter(format, out, []string{"month", "day", "metric", "count", "users"})
+	if err != nil {
+		return err
+	}
+	metrics := map[string]bool{}
+	for _, metric := range f.Metrics {
+		metrics[metric] = true
+	}
+
+	first := time.Date(f.From.Year(), f.From.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for month := first; month.Before(f.To); month = month.AddDate(0, 1, 0) {
+		yearMonth := month.Format("2006-01")
+		content, err := client.Get(yearMonth).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var summary event_aggregator.MonthlySummary
+		if err := json.Unmarshal(content, &summary); err != nil {
+			return fmt.Errorf("reading summary %s: %v", yearMonth, err)
+		}
+		for metric, metricSummary := range summary.Metrics {
+			if len(metrics) > 0 && !metrics[metric] {
+				continue
+			}
+			err := writer.Write([]interface{}{yearMonth, "", metric, metricSummary.Count, metricSummary.Users})
+			if err != nil {
+				return err
+			}
+			for day, daySummary := range metricSummary.Days {
+				err := writer.Write([]interface{}{yearMonth, day, metric, daySummary.Count, daySummary.Users})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return writer.Flush()
+}
+
+// exportLogs streams raw logs whose hour falls in the range. The log
+// aggregator only keeps them with rollups off or log-raw-capture on.
+func exportLogs(f filter, format string, out *bufio.Writer) error {
+	rollup, _ := Config.Bool(ENV, "log-rollup")
+	rawCapture, _ := Config.Bool(ENV, "log-raw-capture")
+	if rollup && !rawCapture {
+		return fmt.Errorf("raw logs are not kept with log-rollup on and log-raw-capture off")
+	}
+	mongoURL := Settings.MongoURL
+	session, err := mgo.Dial(mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	mongoDBName := Settings.MongoDBName
+	mongoCollectionName := Settings.MongoCollectionName
+
+	query := bson.M{"hour": bson.M{"$gte": f.From, "$lt": f.To}}
+	if len(f.Usernames) > 0 {
+		query["metrics.username"] = bson.M{"$in": f.Usernames}
+	}
+	if len(f.Metrics) > 0 {
+		query["metrics.metric"] = bson.M{"$in": f.Metrics}
+	}
+
+	writer, err := newRowWriter(format, out, []string{"id", "hour", "received", "username", "metric", "count"})
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		ID       bson.ObjectId `bson:"_id"`
+		Hour     time.Time     `bson:"hour"`
+		Received time.Time     `bson:"received"`
+		Metrics  struct {
+			Username string `bson:"username"`
+			Count    int64  `bson:"count"`
+			Metric   string `bson:"metric"`
+		} `bson:"metrics"`
+	}
+	iter := session.DB(mongoDBName).C(mongoCollectionName).Find(query).Sort("hour").Iter()
+	for iter.Next(&doc) {
+		err := writer.Write([]interface{}{doc.ID.Hex(), doc.Hour, doc.Received, doc.Metrics.Username, doc.Metrics.Metric, doc.Metrics.Count})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Run streams one data set to a file or stdout:
+//
+//	asynch-workers admin export -source accounts|events|logs [-format csv|ndjson|parquet] [-out file]
+//	       [-from 2015-01-01] [-to 2015-02-01] [-users a,b] [-metrics x,y]
+func Run(conf *config.Config, args []string) {
+	fs := flag.NewFlagSet(COMMAND, flag.ExitOnError)
+	source := fs.String("source", LOGS, "accounts, events or logs")
+	format := fs.String("format", CSV, "csv, ndjson or parquet")
+	outPath := fs.String("out", "", "file to write, stdout when empty")
+	from := fs.String("from", "", "first day to export (YYYY-MM-DD), everything when empty")
+	to := fs.String("to", "", "day to stop before (YYYY-MM-DD), now when empty")
+	users := fs.String("users", "", "comma separated usernames")
+	metrics := fs.String("metrics", "", "comma separated metrics")
+	fs.Parse(args)
+	setConfig(conf)
+
+	f := filter{
+		From:      time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:        time.Now().UTC(),
+		Usernames: config.SplitList(*users),
+		Metrics:   config.SplitList(*metrics),
+	}
+	var err error
+	if *from != "" {
+		if f.From, err = time.Parse(DATE_LAYOUT, *from); err != nil {
+			logger.Fatalf("-from must be formatted YYYY-MM-DD. ERR: %+v", err)
+		}
+	}
+	if *to != "" {
+		if f.To, err = time.Parse(DATE_LAYOUT, *to); err != nil {
+			logger.Fatalf("-to must be formatted YYYY-MM-DD. ERR: %+v", err)
+		}
+	}
+
+	file := os.Stdout
+	if *outPath != "" {
+		file, err = os.Create(*outPath)
+		if err != nil {
+			logger.Fatalf("Failed to create %s. ERR: %+v", *outPath, err)
+		}
+		defer file.Close()
+	}
+	out := bufio.NewWriter(file)
+
+	switch *source {
+	case ACCOUNTS:
+		err = exportAccounts(f, *format, out)
+	case EVENTS:
+		err = exportEvents(f, *format, out)
+	case LOGS:
+		err = exportLogs(f, *format, out)
+	default:
+		err = fmt.Errorf("unknown source %q", *source)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		logger.Fatalf("Failed to export %s. ERR: %s", *source, config.Redact(err.Error()))
+	}
+}
@@ -0,0 +1,336 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// PARQUET_ROW_GROUP_SIZE is how many rows are buffered before they are
+// written as a row group, which bounds the memory an export holds.
+const PARQUET_ROW_GROUP_SIZE = 10000
+
+const (
+	PARQUET_MAGIC   = "PAR1"
+	PARQUET_VERSION = 1
+)
+
+// The parquet.thrift enum values the writer uses.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetDataPage     = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+)
+
+// The thrift compact protocol's field types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetColumn is a column's type and the PLAIN encoded values of the row
+// group being buffered.
+type parquetColumn struct {
+	name         string
+	physical     int32
+	converted    int32
+	hasConverted bool
+	values       bytes.Buffer
+}
+
+type parquetRowGroup struct {
+	rows    int64
+	columns []parquetColumnChunk
+}
+
+type parquetColumnChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetWriter writes uncompressed, PLAIN encoded Parquet with a row group
+// every PARQUET_ROW_GROUP_SIZE rows. The column types follow the first row:
+// int64, string (UTF8) and time.Time (TIMESTAMP_MILLIS); columns without a
+// row are strings. Flush ends the file.
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []*parquetColumn
+	typed   bool
+	rows    int64
+	total   int64
+	groups  []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, columns []string) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w}
+	for _, name := range columns {
+		pw.columns = append(pw.columns, &parquetColumn{name: name, physical: parquetByteArray, converted: parquetUTF8, hasConverted: true})
+	}
+	return pw, pw.write([]byte(PARQUET_MAGIC))
+}
+
+func (pw *parquetWriter) write(p []byte) error {
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	return err
+}
+
+func (pw *parquetWriter) Write(row []interface{}) error {
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("row has %d values for %d columns", len(row), len(pw.columns))
+	}
+	if !pw.typed {
+		for i, value := range row {
+			c := pw.columns[i]
+			switch value.(type) {
+			case int, int64:
+				c.physical, c.hasConverted = parquetInt64, false
+			case time.Time:
+				c.physical, c.converted = parquetInt64, parquetTimestampMillis
+			case string:
+			default:
+				return fmt.Errorf("column %s: parquet output does not support %T", c.name, value)
+			}
+		}
+		pw.typed = true
+	}
+	for i, value := range row {
+		if err := pw.columns[i].add(value); err != nil {
+			return err
+		}
+	}
+	pw.rows++
+	if pw.rows == PARQUET_ROW_GROUP_SIZE {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+func (c *parquetColumn) add(value interface{}) error {
+	var word [8]byte
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case time.Time:
+		value = v.UnixNano() / int64(time.Millisecond)
+	}
+	switch v := value.(type) {
+	case int64:
+		if c.physical != parquetInt64 {
+			return fmt.Errorf("column %s: got %T after a string", c.name, v)
+		}
+		binary.LittleEndian.PutUint64(word[:], uint64(v))
+		c.values.Write(word[:])
+	case string:
+		if c.physical != parquetByteArray {
+			return fmt.Errorf("column %s: got a string after a number", c.name)
+		}
+		binary.LittleEndian.PutUint32(word[:4], uint32(len(v)))
+		c.values.Write(word[:4])
+		c.values.WriteString(v)
+	default:
+		return fmt.Errorf("column %s: parquet output does not support %T", c.name, value)
+	}
+	return nil
+}
+
+// flushRowGroup writes every column's values as a single data page.
+func (pw *parquetWriter) flushRowGroup() error {
+	group := parquetRowGroup{rows: pw.rows}
+	for _, c := range pw.columns {
+		header := &thriftWriter{}
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(c.values.Len()))
+		header.i32(3, int32(c.values.Len()))
+		header.begin(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.close()
+		header.stop()
+
+		chunk := parquetColumnChunk{offset: pw.offset, size: int64(header.buf.Len() + c.values.Len())}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(c.values.Bytes()); err != nil {
+			return err
+		}
+		c.values.Reset()
+		group.columns = append(group.columns, chunk)
+	}
+	pw.groups = append(pw.groups, group)
+	pw.total += pw.rows
+	pw.rows = 0
+	return nil
+}
+
+// Flush writes the buffered rows and the footer.
+func (pw *parquetWriter) Flush() error {
+	if pw.rows > 0 {
+		if err := pw.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	footer := &thriftWriter{}
+	footer.i32(1, PARQUET_VERSION)
+	footer.list(2, thriftStruct, len(pw.columns)+1)
+	footer.open()
+	footer.str(4, "schema")
+	footer.i32(5, int32(len(pw.columns)))
+	footer.close()
+	for _, c := range pw.columns {
+		footer.open()
+		footer.i32(1, c.physical)
+		footer.i32(3, parquetRequired)
+		footer.str(4, c.name)
+		if c.hasConverted {
+			footer.i32(6, c.converted)
+		}
+		footer.close()
+	}
+	footer.i64(3, pw.total)
+	footer.list(4, thriftStruct, len(pw.groups))
+	for _, group := range pw.groups {
+		footer.open()
+		footer.list(1, thriftStruct, len(group.columns))
+		var size int64
+		for i, chunk := range group.columns {
+			c := pw.columns[i]
+			size += chunk.size
+			footer.open()
+			footer.i64(2, chunk.offset)
+			footer.begin(3)
+			footer.i32(1, c.physical)
+			footer.list(2, thriftI32, 1)
+			footer.varint(zigzag(parquetPlain))
+			footer.list(3, thriftBinary, 1)
+			footer.binary(c.name)
+			footer.i32(4, parquetUncompressed)
+			footer.i64(5, group.rows)
+			footer.i64(6, chunk.size)
+			footer.i64(7, chunk.size)
+			footer.i64(9, chunk.offset)
+			footer.close()
+			footer.close()
+		}
+		footer.i64(2, size)
+		footer.i64(3, group.rows)
+		footer.close()
+	}
+	footer.str(6, "asynch-workers export")
+	footer.stop()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(footer.buf.Len()))
+	if err := pw.write(footer.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.write(length[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte(PARQUET_MAGIC))
+}
+
+// thriftWriter encodes structs with the thrift compact protocol, which is
+// what Parquet's page headers and footer are written in.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// last holds the last field id of each struct being written.
+	last []int16
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	if len(t.last) == 0 {
+		t.last = []int16{0}
+	}
+	top := len(t.last) - 1
+	if delta := id - t.last[top]; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last[top] = id
+}
+
+func zigzag(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func (t *thriftWriter) varint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// list starts a list field of size elements of kind.
+func (t *thriftWriter) list(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(0xf0 | kind)
+	t.varint(uint64(size))
+}
+
+// begin starts a struct field, which close finishes.
+func (t *thriftWriter) begin(id int16) {
+	t.field(id, thriftStruct)
+	t.open()
+}
+
+// open starts a struct that is a list element, close finishes it.
+func (t *thriftWriter) open() {
+	if len(t.last) == 0 {
+		t.last = []int16{0}
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) close() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// stop finishes the outermost struct.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+	t.last = nil
+}
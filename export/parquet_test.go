@@ -0,0 +1,97 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestThriftWriter(t *testing.T) {
+	cases := []struct {
+		name  string
+		write func(*thriftWriter)
+		want  []byte
+	}{
+		{"i32", func(w *thriftWriter) { w.i32(1, 3) }, []byte{0x15, 0x06, 0}},
+		{"negative i64", func(w *thriftWriter) { w.i64(2, -1) }, []byte{0x26, 0x01, 0}},
+		{"long field delta", func(w *thriftWriter) { w.i32(20, 1) }, []byte{0x05, 0x28, 0x02, 0}},
+		{"string", func(w *thriftWriter) { w.str(4, "ab") }, []byte{0x48, 0x02, 'a', 'b', 0}},
+		{"nested struct", func(w *thriftWriter) {
+			w.i32(1, 0)
+			w.begin(5)
+			w.i32(1, 1)
+			w.close()
+			w.i32(6, 0)
+		}, []byte{0x15, 0x00, 0x4c, 0x15, 0x02, 0, 0x15, 0x00, 0}},
+		{"list of structs", func(w *thriftWriter) {
+			w.list(2, thriftStruct, 1)
+			w.open()
+			w.i32(1, 1)
+			w.close()
+		}, []byte{0x29, 0x1c, 0x15, 0x02, 0, 0}},
+		{"long list", func(w *thriftWriter) { w.list(1, thriftI32, 15) }, []byte{0x19, 0xf5, 0x0f, 0}},
+	}
+	for _, c := range cases {
+		w := &thriftWriter{}
+		c.write(w)
+		w.stop()
+		if got := w.buf.Bytes(); !bytes.Equal(got, c.want) {
+			t.Errorf("%s: wrote % x, want % x", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParquetLayout(t *testing.T) {
+	for _, rows := range []int{0, 1, PARQUET_ROW_GROUP_SIZE + 1} {
+		var out bytes.Buffer
+		w, err := newRowWriter(PARQUET, &out, []string{"id", "hour", "metric", "count"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < rows; i++ {
+			if err := w.Write([]interface{}{"id", time.Now(), "byte_call", int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		file := out.Bytes()
+		if !bytes.HasPrefix(file, []byte(PARQUET_MAGIC)) || !bytes.HasSuffix(file, []byte(PARQUET_MAGIC)) {
+			t.Fatalf("%d rows: file does not start and end with %s", rows, PARQUET_MAGIC)
+		}
+		footer := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+		if footer <= 0 || footer > len(file)-12 {
+			t.Errorf("%d rows: footer of %d bytes in a file of %d", rows, footer, len(file))
+		}
+		groups := w.(*parquetWriter).groups
+		if want := (rows + PARQUET_ROW_GROUP_SIZE - 1) / PARQUET_ROW_GROUP_SIZE; len(groups) != want {
+			t.Errorf("%d rows: %d row groups, want %d", rows, len(groups), want)
+		}
+	}
+}
+
+func TestParquetRejects(t *testing.T) {
+	cases := []struct {
+		name string
+		rows [][]interface{}
+	}{
+		{"short row", [][]interface{}{{"a"}}},
+		{"unsupported type", [][]interface{}{{"a", 1.5}}},
+		{"string after number", [][]interface{}{{"a", int64(1)}, {"a", "b"}}},
+		{"number after string", [][]interface{}{{"a", int64(1)}, {int64(1), int64(1)}}},
+	}
+	for _, c := range cases {
+		w, _ := newRowWriter(PARQUET, &bytes.Buffer{}, []string{"name", "count"})
+		var err error
+		for _, row := range c.rows {
+			if err = w.Write(row); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: written without an error", c.name)
+		}
+	}
+}
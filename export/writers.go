@@ -0,0 +1,72 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	CSV     = "csv"
+	NDJSON  = "ndjson"
+	PARQUET = "parquet"
+)
+
+// rowWriter streams rows of a fixed set of columns.
+type rowWriter interface {
+	Write(row []interface{}) error
+	Flush() error
+}
+
+func newRowWriter(format string, w io.Writer, columns []string) (rowWriter, error) {
+	switch format {
+	case CSV:
+		writer := csv.NewWriter(w)
+		return &csvWriter{writer}, writer.Write(columns)
+	case NDJSON:
+		return &ndjsonWriter{json.NewEncoder(w), columns}, nil
+	case PARQUET:
+		return newParquetWriter(w, columns)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type csvWriter struct {
+	*csv.Writer
+}
+
+func (w *csvWriter) Write(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, value := range row {
+		if t, ok := value.(time.Time); ok {
+			record[i] = t.UTC().Format(time.RFC3339)
+			continue
+		}
+		record[i] = fmt.Sprint(value)
+	}
+	return w.Writer.Write(record)
+}
+
+func (w *csvWriter) Flush() error {
+	w.Writer.Flush()
+	return w.Writer.Error()
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+	columns []string
+}
+
+func (w *ndjsonWriter) Write(row []interface{}) error {
+	object := make(map[string]interface{}, len(row))
+	for i, value := range row {
+		object[w.columns[i]] = value
+	}
+	return w.encoder.Encode(object)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package fault
+
+import (
+	"net/http"
+)
+
+// The classes of failure, which decide what becomes of a delivery or a
+// request.
+const (
+	// RETRYABLE failures, like a store being down, may pass; the delivery
+	// is requeued.
+	RETRYABLE = "retryable"
+	// PERMANENT failures, like a row the store rejects, recur on every
+	// attempt; the delivery is dead-lettered for someone to look at.
+	PERMANENT = "permanent"
+	// POISON messages cannot be handled at all, like bad JSON; the
+	// delivery is dropped.
+	POISON = "poison"
+)
+
+// Error is a failure of a known class.
+type Error struct {
+	Class string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Class + ": " + e.Err.Error()
+}
+
+func Retryable(err error) error {
+	return classify(RETRYABLE, err)
+}
+
+func Permanent(err error) error {
+	return classify(PERMANENT, err)
+}
+
+func Poison(err error) error {
+	return classify(POISON, err)
+}
+
+// classify keeps the class of an error that already has one.
+func classify(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// Class is the class of err, "" for nil. Errors nobody classified are
+// RETRYABLE, since most failures are a store or the broker being
+// unavailable.
+func Class(err error) string {
+	if err == nil {
+		return ""
+	}
+	if classified, ok := err.(*Error); ok {
+		return classified.Class
+	}
+	return RETRYABLE
+}
+
+// Status is the HTTP status answering a request that failed with err: a
+// poison request is the client's fault, a retryable failure asks it to try
+// again later.
+func Status(err error) int {
+	switch Class(err) {
+	case "":
+		return http.StatusOK
+	case POISON:
+		return http.StatusBadRequest
+	case PERMANENT:
+		return http.StatusInternalServerError
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,37 @@
+package fault
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClass(t *testing.T) {
+	errDown := errors.New("store is down")
+	cases := []struct {
+		err    error
+		class  string
+		status int
+	}{
+		{nil, "", http.StatusOK},
+		{errDown, RETRYABLE, http.StatusServiceUnavailable},
+		{Retryable(errDown), RETRYABLE, http.StatusServiceUnavailable},
+		{Permanent(errDown), PERMANENT, http.StatusInternalServerError},
+		{Poison(errDown), POISON, http.StatusBadRequest},
+		{Retryable(Poison(errDown)), POISON, http.StatusBadRequest},
+		{Poison(Permanent(errDown)), PERMANENT, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if got := Class(c.err); got != c.class {
+			t.Errorf("Class(%v) = %q, want %q", c.err, got, c.class)
+		}
+		if got := Status(c.err); got != c.status {
+			t.Errorf("Status(%v) = %d, want %d", c.err, got, c.status)
+		}
+	}
+	for _, classify := range []func(error) error{Retryable, Permanent, Poison} {
+		if err := classify(nil); err != nil {
+			t.Errorf("classifying nil gave %v", err)
+		}
+	}
+}
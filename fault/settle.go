@@ -0,0 +1,73 @@
+package fault
+
+import (
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/streadway/amqp"
+)
+
+// DEAD_SUFFIX names the queue collecting the dead letters of a queue.
+const DEAD_SUFFIX = ".dead"
+
+// Settler settles the deliveries of Queue by the class of their handler's
+// error: nil acks, RETRYABLE requeues, PERMANENT dead-letters and POISON
+// drops. Dead letters are published under their routing key to an exchange
+// of Queue's own, named after DeadLetter; without one they are dropped like
+// poison.
+type Settler struct {
+	Broker     broker.Broker
+	Queue      string
+	DeadLetter string
+}
+
+// NewSettler declares <queue>.dead as the only queue of the <deadLetter>.<queue>
+// exchange, so the dead letters of a queue are kept apart until someone reads
+// them.
+func NewSettler(b broker.Broker, queue string, deadLetter string) (*Settler, error) {
+	if deadLetter != "" {
+		// The dead letters are not worth sharding.
+		declarer := b
+		if sharded, ok := b.(*broker.Sharded); ok {
+			declarer = sharded.Broker
+		}
+		if err := declarer.Declare(deadLetterExchange(deadLetter, queue), queue+DEAD_SUFFIX, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &Settler{Broker: b, Queue: queue, DeadLetter: deadLetter}, nil
+}
+
+// deadLetterExchange is a queue's own dead-letter exchange. Whatever the
+// exchange kind, binding <queue>.dead alone to it keeps another queue's dead
+// letters out.
+func deadLetterExchange(deadLetter string, queue string) string {
+	return deadLetter + "." + queue
+}
+
+func (s *Settler) Settle(d amqp.Delivery, err error) {
+	l := logger.ForDelivery(s.Queue, d)
+	switch Class(err) {
+	case "":
+		d.Ack(false)
+	case RETRYABLE:
+		l.Warnf("Requeuing a metric of %s. ERR: %s", s.Queue, config.Redact(err.Error()))
+		d.Nack(false, true)
+	case PERMANENT:
+		if s.DeadLetter == "" {
+			l.Errorf("Dropping a metric of %s. ERR: %s", s.Queue, config.Redact(err.Error()))
+			d.Ack(false)
+			return
+		}
+		if perr := s.Broker.Publish(deadLetterExchange(s.DeadLetter, s.Queue), d.RoutingKey, d.Body, d.CorrelationId); perr != nil {
+			l.Errorf("Failed to dead-letter a metric of %s, requeuing it. ERR: %s", s.Queue, config.Redact(perr.Error()))
+			d.Nack(false, true)
+			return
+		}
+		l.Warnf("Dead-lettered a metric of %s. ERR: %s", s.Queue, config.Redact(err.Error()))
+		d.Ack(false)
+	case POISON:
+		l.Errorf("Dropping a poison metric of %s: %q. ERR: %+v", s.Queue, d.Body, err)
+		d.Ack(false)
+	}
+}
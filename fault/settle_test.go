@@ -0,0 +1,99 @@
+package fault
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/streadway/amqp"
+)
+
+// settlement records how a delivery was settled.
+type settlement struct {
+	acked, nacked, requeued bool
+}
+
+func (s *settlement) Ack(tag uint64, multiple bool) error {
+	s.acked = true
+	return nil
+}
+
+func (s *settlement) Nack(tag uint64, multiple bool, requeue bool) error {
+	s.nacked, s.requeued = true, requeue
+	return nil
+}
+
+func (s *settlement) Reject(tag uint64, requeue bool) error {
+	return s.Nack(tag, false, requeue)
+}
+
+// failingPublish is a broker whose publishing fails.
+type failingPublish struct {
+	*broker.Memory
+}
+
+func (b failingPublish) Publish(exchange string, key string, body []byte, correlationID string) error {
+	return errors.New("broker is down")
+}
+
+func TestSettle(t *testing.T) {
+	errStore := errors.New("store failed")
+	cases := []struct {
+		name       string
+		err        error
+		deadLetter string
+		broken     bool
+		want       settlement
+		dead       int
+	}{
+		{"handled", nil, "dlx", false, settlement{acked: true}, 0},
+		{"retryable", errStore, "dlx", false, settlement{nacked: true, requeued: true}, 0},
+		{"permanent", Permanent(errStore), "dlx", false, settlement{acked: true}, 1},
+		{"permanent without dead letters", Permanent(errStore), "", false, settlement{acked: true}, 0},
+		{"permanent while the broker is down", Permanent(errStore), "dlx", true, settlement{nacked: true, requeued: true}, 0},
+		{"poison", Poison(errStore), "dlx", false, settlement{acked: true}, 0},
+	}
+	for _, c := range cases {
+		memory := broker.NewMemory(broker.FANOUT)
+		var b broker.Broker = memory
+		if c.broken {
+			b = failingPublish{memory}
+		}
+		s, err := NewSettler(b, "accq", c.deadLetter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got settlement
+		s.Settle(amqp.Delivery{Acknowledger: &got, RoutingKey: "metric.login", Body: []byte("{}")}, c.err)
+		if got != c.want {
+			t.Errorf("%s: settled %+v, want %+v", c.name, got, c.want)
+		}
+		if dead := memory.Pending("accq" + DEAD_SUFFIX); dead != c.dead {
+			t.Errorf("%s: %d dead letters, want %d", c.name, dead, c.dead)
+		}
+	}
+}
+
+// Each queue's dead letters stay in its own dead queue.
+func TestDeadLettersPerQueue(t *testing.T) {
+	b := broker.NewMemory(broker.TOPIC)
+	queues := []string{"accq", "nameq", "logq"}
+	settlers := map[string]*Settler{}
+	for _, queue := range queues {
+		s, err := NewSettler(b, queue, "dlx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		settlers[queue] = s
+	}
+	settlers["nameq"].Settle(amqp.Delivery{Acknowledger: &settlement{}, RoutingKey: "metric.login"}, Permanent(errors.New("rejected")))
+	for _, queue := range queues {
+		want := 0
+		if queue == "nameq" {
+			want = 1
+		}
+		if got := b.Pending(queue + DEAD_SUFFIX); got != want {
+			t.Errorf("%s has %d dead letters, want %d", queue+DEAD_SUFFIX, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package leaderboard
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/data"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	DAY   = "day"
+	WEEK  = "week"
+	MONTH = "month"
+
+	KEY_PREFIX = "top:"
+)
+
+var Windows = []string{DAY, WEEK, MONTH}
+
+// Entry is a ranked member of a leaderboard. Rank starts at 1.
+type Entry struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	Rank   int64   `json:"rank"`
+}
+
+func IsWindow(window string) bool {
+	for _, w := range Windows {
+		if w == window {
+			return true
+		}
+	}
+	return false
+}
+
+// Period names the day, ISO week or month containing t.
+func Period(window string, t time.Time) string {
+	t = t.UTC()
+	switch window {
+	case DAY:
+		return t.Format("2006-01-02")
+	case WEEK:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+// start returns the beginning of the window containing t.
+func start(window string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch window {
+	case DAY:
+		return day
+	case WEEK:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func end(window string, t time.Time) time.Time {
+	s := start(window, t)
+	switch window {
+	case DAY:
+		return s.AddDate(0, 0, 1)
+	case WEEK:
+		return s.AddDate(0, 0, 7)
+	default:
+		return s.AddDate(0, 1, 0)
+	}
+}
+
+// Key is the sorted set ranking users for a metric, or ranking metrics when
+// metric is empty.
+func Key(window string, t time.Time, metric string) string {
+	key := KEY_PREFIX + window + ":" + Period(window, t)
+	if metric != "" {
+		key += " " + metric
+	}
+	return key
+}
+
+// Expiry keeps a window readable for one more window after it closes.
+func Expiry(window string, t time.Time) time.Time {
+	closed := end(window, t)
+	return closed.Add(closed.Sub(start(window, t)))
+}
+
+// Record adds the metric to the user and metric leaderboards of every window.
+func Record(pipe redisclient.Commands, metric data.Metric, t time.Time) {
+	for _, window := range Windows {
+		users := Key(window, t, metric.Metric)
+		metrics := Key(window, t, "")
+		pipe.ZIncrBy(users, float64(metric.Count), metric.Username)
+		pipe.ZIncrBy(metrics, float64(metric.Count), metric.Metric)
+		pipe.ExpireAt(users, Expiry(window, t))
+		pipe.ExpireAt(metrics, Expiry(window, t))
+	}
+}
+
+func Top(client redisclient.Commands, key string, n int64) ([]Entry, error) {
+	members, err := client.ZRevRangeWithScores(key, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, len(members))
+	for i, z := range members {
+		entries[i] = Entry{Member: fmt.Sprint(z.Member), Score: z.Score, Rank: int64(i + 1)}
+	}
+	return entries, nil
+}
+
+// Rank returns nil if member is not on the leaderboard.
+func Rank(client redisclient.Commands, key string, member string) (*Entry, error) {
+	rank, err := client.ZRevRank(key, member).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	score, err := client.ZScore(key, member).Result()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Member: member, Score: score, Rank: rank + 1}, nil
+}
@@ -0,0 +1,350 @@
+package log_aggregator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	ARCHIVE_JOB = "archive-logs"
+	DAY_LAYOUT  = "2006-01-02"
+	// ARCHIVED_FIELD is set on the logs of a day once it is archived. Only
+	// those expire, so retention never drops a day missing from the archive.
+	ARCHIVED_FIELD = "archived"
+
+	LOCK_COLLECTION  = "locks"
+	ARCHIVE_LOCK_TTL = time.Hour
+)
+
+var (
+	// ErrArchiving fails an archive run while another replica is archiving.
+	ErrArchiving = errors.New("archive lock is held")
+	// ErrLockLost stops an archive run whose lock expired or was taken over
+	// before its files were written.
+	ErrLockLost = errors.New("archive lock was lost")
+)
+
+// Manifest describes one archived day. It is written after the archive
+// itself, so a day with a manifest is completely archived.
+type Manifest struct {
+	Day        string
+	Collection string
+	File       string
+	Documents  int
+	Bytes      int64
+	SHA256     string
+	Created    time.Time
+}
+
+func archiveName(day time.Time) string {
+	return "logs-" + day.Format(DAY_LAYOUT) + ".ndjson.gz"
+}
+
+func manifestName(day time.Time) string {
+	return "logs-" + day.Format(DAY_LAYOUT) + ".manifest.json"
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// archiveClosedDays archives every day before now's that has logs not marked
+// archived yet, holding the archive lock so replicas do not archive the same
+// days. The lock is renewed while the run lasts, and checked before each
+// archive and manifest is put in place.
+func archiveClosedDays(c *mgo.Collection, dir string, now time.Time) error {
+	lock := newMongoLock(c.Database.C(LOCK_COLLECTION), ARCHIVE_JOB, ARCHIVE_LOCK_TTL)
+	acquired, err := lock.acquire()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return ErrArchiving
+	}
+	stop := lock.keep()
+	defer func() {
+		close(stop)
+		if err := lock.release(); err != nil {
+			logger.Errorf("Error in releasing the archive lock. ERR: %+v", err)
+		}
+	}()
+
+	today := startOfDay(now)
+	for {
+		var first Log
+		err := c.Find(bson.M{ARCHIVED_FIELD: bson.M{"$exists": false}, "received": bson.M{"$lt": today}}).Sort("received").One(&first)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		day := startOfDay(first.Received)
+		manifest, err := archiveDay(c, dir, day, lock.check)
+		if err != nil {
+			return err
+		}
+		_, err = c.UpdateAll(
+			bson.M{"received": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}},
+			bson.M{"$set": bson.M{ARCHIVED_FIELD: time.Now().UTC()}},
+		)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Archived %d logs of %s to %s", manifest.Documents, manifest.Day, manifest.File)
+	}
+}
+
+// mongoLock is a document in the locks collection that expires after ttl,
+// so a crashed holder cannot keep it forever.
+type mongoLock struct {
+	c     *mgo.Collection
+	id    string
+	ttl   time.Duration
+	token string
+}
+
+func newMongoLock(c *mgo.Collection, id string, ttl time.Duration) *mongoLock {
+	host, _ := os.Hostname()
+	return &mongoLock{c: c, id: id, ttl: ttl, token: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())}
+}
+
+// acquire reports whether the lock was taken. A held lock fails the upsert
+// with a duplicate _id.
+func (l *mongoLock) acquire() (bool, error) {
+	now := time.Now().UTC()
+	_, err := l.c.Upsert(
+		bson.M{"_id": l.id, "$or": []bson.M{{"expires": bson.M{"$lt": now}}, {"holder": l.token}}},
+		bson.M{"$set": bson.M{"holder": l.token, "expires": now.Add(l.ttl)}},
+	)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// extend pushes the expiry of a lock still held back by ttl and reports
+// whether it was.
+func (l *mongoLock) extend() (bool, error) {
+	now := time.Now().UTC()
+	err := l.c.Update(
+		bson.M{"_id": l.id, "holder": l.token, "expires": bson.M{"$gte": now}},
+		bson.M{"$set": bson.M{"expires": now.Add(l.ttl)}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// keep extends the lock every third of its ttl until stop is closed.
+func (l *mongoLock) keep() chan bool {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				held, err := l.extend()
+				if err != nil {
+					logger.Errorf("Failed to extend the %s lock. ERR: %+v", l.id, err)
+				} else if !held {
+					logger.Errorf("Lost the %s lock", l.id)
+					return
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// check fails with ErrLockLost unless the lock is still held and unexpired.
+func (l *mongoLock) check() error {
+	n, err := l.c.Find(bson.M{"_id": l.id, "holder": l.token, "expires": bson.M{"$gte": time.Now().UTC()}}).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+func (l *mongoLock) release() error {
+	err := l.c.Remove(bson.M{"_id": l.id, "holder": l.token})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// archiveDay writes the day's logs as gzipped NDJSON and then its manifest,
+// each put in place only while held reports no error.
+func archiveDay(c *mgo.Collection, dir string, day time.Time, held func() error) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := archiveName(day)
+	tmp := filepath.Join(dir, name+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, hash)}
+	zw := gzip.NewWriter(counter)
+	encoder := json.NewEncoder(zw)
+
+	documents := 0
+	var doc Log
+	iter := c.Find(bson.M{"received": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}).Sort("received").Iter()
+	for iter.Next(&doc) {
+		if err := encoder.Encode(&doc); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		documents++
+		doc = Log{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := held(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Day:        day.Format(DAY_LAYOUT),
+		Collection: c.FullName,
+		File:       name,
+		Documents:  documents,
+		Bytes:      counter.n,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+		Created:    time.Now().UTC(),
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := held(); err != nil {
+		return nil, err
+	}
+	return manifest, writeFileAtomic(filepath.Join(dir, manifestName(day)), content)
+}
+
+// restoreArchive verifies the archive named by the manifest and inserts its
+// logs into c, skipping the ones already there.
+func restoreArchive(c *mgo.Collection, manifestPath string) (int, error) {
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return 0, err
+	}
+
+	path := filepath.Join(filepath.Dir(manifestPath), manifest.File)
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return 0, err
+	}
+	if sum != manifest.SHA256 {
+		return 0, fmt.Errorf("checksum mismatch for %s: manifest %s, file %s", path, manifest.SHA256, sum)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	restored := 0
+	decoder := json.NewDecoder(zr)
+	for {
+		var doc Log
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, err
+		}
+		err = c.Insert(&doc)
+		if err != nil && !mgo.IsDup(err) {
+			return restored, err
+		}
+		restored++
+	}
+	if restored != manifest.Documents {
+		return restored, fmt.Errorf("restored %d logs, manifest lists %d", restored, manifest.Documents)
+	}
+	return restored, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,365 @@
+package log_aggregator
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/data"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/pool"
+	"github.com/streadway/amqp"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	DEFAULT_BATCH_INTERVAL = 500 * time.Millisecond
+	// MONGO_VALIDATION_ERR is the code of a document failing the
+	// collection's validator.
+	MONGO_VALIDATION_ERR = 121
+)
+
+// entry is a buffered delivery and the log decoded from it.
+type entry struct {
+	log      *Log
+	received time.Time
+	delivery amqp.Delivery
+}
+
+// batchWriter buffers logs until it holds size documents or interval has
+// passed, writes them and only then acks their deliveries. Raw documents go
+// to raw, hourly rollups to rollups; either may be nil to turn it off.
+type batchWriter struct {
+	raw        *mgo.Collection
+	rollups    *mgo.Collection
+	size       int
+	interval   time.Duration
+	retryCount int
+
+	entries []entry
+	resize  chan batchSettings
+	// limit lowers size when the adaptive concurrency asks for smaller
+	// batches, 0 keeps size.
+	limit  int
+	limits chan int
+	// latency measures the writes to MongoDB.
+	latency pool.Meter
+	// store counts the failed writes and pause stops the consumer once it
+	// opens; nil writes regardless.
+	store *circuit.Breaker
+	pause func()
+	// settler settles what cannot be acked with the batch.
+	settler *fault.Settler
+	// writeBatch writes what pending has left of the batch, write unless a
+	// test replaces it.
+	writeBatch func(pending *batchState) error
+	// session, when set, returns a session to write each batch on and close
+	// afterwards, so that a redialed session takes over.
+	session func() *mgo.Session
+}
+
+// batchSettings are the options of a batchWriter that a reload may change.
+type batchSettings struct {
+	size       int
+	interval   time.Duration
+	retryCount int
+}
+
+func newBatchWriter(raw *mgo.Collection, rollups *mgo.Collection, size int, interval time.Duration, retryCount int) *batchWriter {
+	w := &batchWriter{
+		raw:     raw,
+		rollups: rollups,
+		resize:  make(chan batchSettings, 1),
+		limits:  make(chan int, 1),
+	}
+	w.writeBatch = w.write
+	w.apply(batchSettings{size: size, interval: interval, retryCount: retryCount})
+	return w
+}
+
+func (w *batchWriter) apply(settings batchSettings) {
+	if settings.size <= 0 {
+		settings.size = 1
+	}
+	if settings.interval <= 0 {
+		settings.interval = DEFAULT_BATCH_INTERVAL
+	}
+	w.size = settings.size
+	w.interval = settings.interval
+	w.retryCount = settings.retryCount
+}
+
+// setLimit hands a batch size limit to run.
+func (w *batchWriter) setLimit(limit int) {
+	select {
+	case <-w.limits:
+	default:
+	}
+	w.limits <- limit
+}
+
+func (w *batchWriter) batchSize() int {
+	if w.limit > 0 && w.limit < w.size {
+		return w.limit
+	}
+	return w.size
+}
+
+// reconfigure hands new settings to run, which applies them between batches.
+func (w *batchWriter) reconfigure(settings batchSettings) {
+	select {
+	case <-w.resize:
+	default:
+	}
+	w.resize <- settings
+}
+
+func (w *batchWriter) run(msgs <-chan amqp.Delivery) {
+	ticker := time.NewTicker(w.interval)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				w.flush()
+				return
+			}
+			var metric data.Metric
+			if err := json.Unmarshal(d.Body, &metric); err != nil {
+				w.settler.Settle(d, fault.Poison(err))
+				continue
+			}
+			logger.ForDelivery(Settings.LogQ, d).With(logger.MetricFields(metric.Username, metric.Metric, metric.Count)).Infof("Metric")
+			w.add(newLog(metric), d)
+			if len(w.entries) >= w.batchSize() {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		case settings := <-w.resize:
+			w.apply(settings)
+			ticker.Stop()
+			ticker = time.NewTicker(w.interval)
+			logger.Infof("Batching %d logs every %s with %d retries", w.size, w.interval, w.retryCount)
+			if len(w.entries) >= w.batchSize() {
+				w.flush()
+			}
+		case w.limit = <-w.limits:
+			if len(w.entries) >= w.batchSize() {
+				w.flush()
+			}
+		}
+	}
+}
+
+func (w *batchWriter) add(metricLog *Log, d amqp.Delivery) {
+	// The id is set here so that retrying a partially inserted batch
+	// cannot duplicate documents.
+	metricLog.ID = logID(d)
+	w.entries = append(w.entries, entry{log: metricLog, received: time.Now().UTC(), delivery: d})
+}
+
+// logID derives the id of a log from its request id and body, so that a
+// requeued delivery finds the document it already inserted. Deliveries
+// without a request id get a fresh one.
+func logID(d amqp.Delivery) bson.ObjectId {
+	if d.CorrelationId == "" {
+		return bson.NewObjectId()
+	}
+	sum := sha1.Sum(append([]byte(d.CorrelationId+"\n"), d.Body...))
+	return bson.ObjectId(sum[:12])
+}
+
+func (w *batchWriter) flush() {
+	if len(w.entries) == 0 {
+		return
+	}
+	if w.session != nil {
+		session := w.session()
+		defer session.Close()
+		w.raw, w.rollups = withSession(w.raw, session), withSession(w.rollups, session)
+	}
+	pending := &batchState{}
+	if w.rollups != nil {
+		pending.rollups = rollupBatch(w.entries)
+	}
+	backoff := 2 * time.Second
+	var err error
+	paused := false
+	for i := 0; i <= w.retryCount; i++ {
+		if w.store != nil && !w.store.Allow() {
+			err = circuit.ErrOpen
+			break
+		}
+		start := time.Now()
+		err = w.writeBatch(pending)
+		w.latency.Record(time.Since(start))
+		if w.store != nil && w.store.Record(err) {
+			paused = true
+		}
+		if err == nil || fault.Class(err) == fault.PERMANENT {
+			break
+		}
+		w.logger().Errorf("Failed to write %d logs. ERR: %+v", len(w.entries), err)
+		if i < w.retryCount && (w.store == nil || w.store.Allow()) {
+			logger.Warnf("Backing off for %s", backoff)
+			<-time.After(backoff)
+			backoff = backoff * 2
+		}
+	}
+
+	// The batch is settled before the consumer pauses, since pausing may
+	// requeue whatever it has not acked yet, the written logs included.
+	w.settle(pending, err)
+	w.entries = w.entries[:0]
+	if paused {
+		logger.Warnf("Pausing %s", Settings.LogQ)
+		w.pause()
+	}
+}
+
+func (w *batchWriter) settle(pending *batchState, err error) {
+	if fault.Class(err) == fault.PERMANENT {
+		w.writeEach()
+		return
+	}
+	if err != nil {
+		w.requeue(pending)
+		return
+	}
+	// Deliveries of one channel arrive in order, so acking the last one of
+	// each with multiple set covers the whole batch, even when sharded
+	// queues merge several channels.
+	w.logger().Infof("Wrote %d logs", len(w.entries))
+	for _, last := range w.lastDeliveries() {
+		last.Ack(true)
+	}
+}
+
+func withSession(c *mgo.Collection, session *mgo.Session) *mgo.Collection {
+	if c == nil {
+		return nil
+	}
+	return c.With(session)
+}
+
+// requeue settles a batch whose retries ran out. The logs that are fully
+// written are acked, since their rollups must not be applied again, and the
+// rest go back to the queue.
+func (w *batchWriter) requeue(pending *batchState) {
+	for _, e := range w.entries {
+		if (w.raw == nil || pending.rawWritten) && pending.rollups[rollupKeyOf(e)] == nil {
+			e.delivery.Ack(false)
+		} else {
+			e.delivery.Nack(false, true)
+		}
+	}
+}
+
+// logger tags the lines of a batch with the request ids of its logs.
+func (w *batchWriter) logger() *logger.Logger {
+	ids := make([]string, len(w.entries))
+	for i, e := range w.entries {
+		ids[i] = e.delivery.CorrelationId
+	}
+	return logger.With(logger.Fields{"queue": Settings.LogQ, "request_ids": ids})
+}
+
+// lastDeliveries returns the last delivery of the batch per channel.
+func (w *batchWriter) lastDeliveries() []amqp.Delivery {
+	index := map[amqp.Acknowledger]int{}
+	var last []amqp.Delivery
+	for _, e := range w.entries {
+		if i, ok := index[e.delivery.Acknowledger]; ok {
+			last[i] = e.delivery
+		} else {
+			index[e.delivery.Acknowledger] = len(last)
+			last = append(last, e.delivery)
+		}
+	}
+	return last
+}
+
+// batchState remembers what a retried batch already wrote. Rollup upserts
+// are not idempotent, so a retry only applies the ones still pending.
+type batchState struct {
+	rawWritten bool
+	rollups    map[rollupKey]*Rollup
+}
+
+func (w *batchWriter) write(pending *batchState) error {
+	if w.raw != nil && !pending.rawWritten {
+		if err := w.insertRaw(); err != nil {
+			return mongoFault(err)
+		}
+		pending.rawWritten = true
+	}
+	for key, r := range pending.rollups {
+		if err := upsertRollup(w.rollups, r); err != nil {
+			return mongoFault(err)
+		}
+		delete(pending.rollups, key)
+	}
+	return nil
+}
+
+// mongoFault classifies a write error. Only a document the validator
+// rejects fails the same way every time.
+func mongoFault(err error) error {
+	if lastErr, ok := err.(*mgo.LastError); ok && lastErr.Code == MONGO_VALIDATION_ERR {
+		return fault.Permanent(err)
+	}
+	return fault.Retryable(err)
+}
+
+// writeEach writes a batch MongoDB rejected one log at a time, so that only
+// the rejected ones are dead-lettered, and rolls up the rest.
+func (w *batchWriter) writeEach() {
+	var written []entry
+	for _, e := range w.entries {
+		if w.raw == nil {
+			written = append(written, e)
+			continue
+		}
+		if err := w.raw.Insert(e.log); err != nil && !mgo.IsDup(err) {
+			w.settler.Settle(e.delivery, mongoFault(err))
+			continue
+		}
+		written = append(written, e)
+	}
+	// Only the logs of a rollup that failed are settled with its error.
+	failed := map[rollupKey]error{}
+	if w.rollups != nil {
+		for key, r := range rollupBatch(written) {
+			if err := upsertRollup(w.rollups, r); err != nil {
+				failed[key] = mongoFault(err)
+			}
+		}
+	}
+	for _, e := range written {
+		w.settler.Settle(e.delivery, failed[rollupKeyOf(e)])
+	}
+	w.logger().Infof("Wrote %d of %d logs", len(written), len(w.entries))
+}
+
+func (w *batchWriter) insertRaw() error {
+	docs := make([]interface{}, len(w.entries))
+	for i, e := range w.entries {
+		docs[i] = e.log
+	}
+	err := w.raw.Insert(docs...)
+	if err == nil || !mgo.IsDup(err) {
+		return err
+	}
+	// An earlier attempt got part of the batch in; insert the rest one by one.
+	for _, doc := range docs {
+		err := w.raw.Insert(doc)
+		if err != nil && !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return nil
+}
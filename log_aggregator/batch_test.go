@@ -0,0 +1,64 @@
+package log_aggregator
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/data"
+	"github.com/arvindram03/asynch-workers/fault"
+	"labix.org/v2/mgo"
+)
+
+// A batch that trips the breaker is settled before the consumer pauses, so
+// the logs it wrote stay acked and only the rest are requeued.
+func TestFlushSettlesBeforePausing(t *testing.T) {
+	b := broker.NewMemory(broker.FANOUT)
+	msgs, err := b.Consume("ex", "logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []data.Metric{{Username: "written", Metric: "login", Count: 1}, {Username: "failed", Metric: "login", Count: 1}}
+	for _, metric := range metrics {
+		body, _ := json.Marshal(metric)
+		if err := b.Publish("ex", "", body, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := newBatchWriter(nil, &mgo.Collection{}, 10, time.Hour, 0)
+	w.store = circuit.New("mongodb", 1, time.Hour, nil)
+	w.pause = func() { b.Cancel("logs") }
+	for _, metric := range metrics {
+		select {
+		case d := <-msgs:
+			w.add(newLog(metric), d)
+		case <-time.After(time.Second):
+			t.Fatal("no delivery within a second")
+		}
+	}
+	w.writeBatch = func(pending *batchState) error {
+		delete(pending.rollups, rollupKeyOf(w.entries[0]))
+		return fault.Retryable(errors.New("connection reset"))
+	}
+	w.flush()
+
+	if _, ok := <-msgs; ok {
+		t.Fatal("deliveries still open after the pause")
+	}
+	if got := b.Pending("logs"); got != 1 {
+		t.Fatalf("%d pending after the pause, want only the unwritten log", got)
+	}
+	msgs, err = b.Consume("ex", "logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metric data.Metric
+	json.Unmarshal((<-msgs).Body, &metric)
+	if metric.Username != "failed" {
+		t.Errorf("requeued %q, want the unwritten log", metric.Username)
+	}
+}
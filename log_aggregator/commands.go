@@ -0,0 +1,77 @@
+package log_aggregator
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/scheduler"
+	"labix.org/v2/mgo"
+)
+
+const (
+	ARCHIVE_COMMAND = "archive"
+	RESTORE_COMMAND = "restore"
+)
+
+// runArchiveCommand archives every closed day once:
+//
+//	asynch-workers admin archive
+func runArchiveCommand(raw *mgo.Collection, dir string) {
+	if err := archiveClosedDays(raw, dir, time.Now()); err != nil {
+		logger.Fatalf("Failed to archive logs. ERR: %+v", err)
+	}
+}
+
+// runRestoreCommand loads an archived day back for audits:
+//
+//	asynch-workers admin restore -manifest archive/logs-2015-01-05.manifest.json [-collection logs_restored]
+//
+// It restores into a separate collection by default since the logs
+// collection would archive the documents again.
+func runRestoreCommand(db *mgo.Database, args []string) {
+	defaultCollection, _ := Config.String(ENV, "mongo-restore-collection-name")
+	fs := flag.NewFlagSet(RESTORE_COMMAND, flag.ExitOnError)
+	manifest := fs.String("manifest", "", "manifest of the archived day to restore")
+	collection := fs.String("collection", defaultCollection, "collection to restore into")
+	fs.Parse(args)
+	if *manifest == "" || *collection == "" {
+		fmt.Fprintln(os.Stderr, "restore: -manifest and -collection are required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	restored, err := restoreArchive(db.C(*collection), *manifest)
+	if err != nil {
+		logger.Fatalf("Failed to restore %s after %d logs. ERR: %+v", *manifest, restored, err)
+	}
+	logger.Infof("Restored %d logs into %s", restored, *collection)
+}
+
+// scheduleArchival archives on a copy of the current session every run.
+func scheduleArchival(db *mgo.Database, raw *mgo.Collection, dir string) *scheduler.Scheduler {
+	spec, _ := Config.String(ENV, "archive-schedule")
+	schedule, err := scheduler.Parse(spec)
+	if err != nil {
+		logger.Fatalf("Invalid archive-schedule. ERR: %+v", err)
+	}
+	retryCount := Settings.RetryCount
+
+	store := scheduler.NewMongoStore(db.C(SCHEDULER_COLLECTION))
+	store.Session = copySession
+	s := scheduler.New(store)
+	s.Add(&scheduler.Job{
+		Name:     ARCHIVE_JOB,
+		Schedule: schedule,
+		Retry:    scheduler.RetryPolicy{Attempts: retryCount, Backoff: 2 * time.Second},
+		Run: func(scheduled time.Time) error {
+			session := copySession()
+			defer session.Close()
+			return archiveClosedDays(raw.With(session), dir, scheduled)
+		},
+	})
+	s.Start()
+	return s
+}
@@ -0,0 +1,133 @@
+package log_aggregator
+
+import (
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ensureIndexes creates the indexes queries over logs and rollups rely on.
+// Either collection may be nil. A positive retention expires raw logs that
+// long after their day was archived.
+func ensureIndexes(raw *mgo.Collection, rollups *mgo.Collection, retention time.Duration) error {
+	if raw != nil {
+		if err := ensureRetention(raw, retention); err != nil {
+			return err
+		}
+		for _, key := range [][]string{
+			{"received"},
+			{"hour"},
+			{"metrics.username"},
+			{"metrics.metric"},
+			{"hour", "metrics.username", "metrics.metric"},
+		} {
+			err := raw.EnsureIndex(mgo.Index{Key: key, Background: true})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if rollups != nil {
+		err := rollups.EnsureIndex(mgo.Index{Key: []string{"hour", "username", "metric"}, Unique: true})
+		if err != nil {
+			return err
+		}
+		for _, key := range [][]string{{"username"}, {"metric"}} {
+			err := rollups.EnsureIndex(mgo.Index{Key: key, Background: true})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureRetention keeps the expiry of the archived index at retention,
+// changing it in place since EnsureIndex refuses a different one. Earlier
+// versions expired logs on received, archived or not, so that index goes.
+func ensureRetention(c *mgo.Collection, retention time.Duration) error {
+	indexes, err := c.Indexes()
+	if err != nil {
+		return err
+	}
+	retention = retention / time.Second * time.Second
+	for _, index := range indexes {
+		if len(index.Key) != 1 || index.ExpireAfter == 0 {
+			continue
+		}
+		switch {
+		case index.Key[0] == "received":
+			logger.Infof("Dropping the expiry on received of %s", c.FullName)
+			if err := c.DropIndex("received"); err != nil {
+				return err
+			}
+		case index.Key[0] != ARCHIVED_FIELD:
+		case retention <= 0:
+			logger.Infof("Turning off the expiry of %s", c.FullName)
+			return c.DropIndex(ARCHIVED_FIELD)
+		case index.ExpireAfter != retention:
+			logger.Infof("Changing the expiry of %s from %s to %s", c.FullName, index.ExpireAfter, retention)
+			return c.Database.Run(bson.D{
+				{Name: "collMod", Value: c.Name},
+				{Name: "index", Value: bson.M{"keyPattern": bson.M{ARCHIVED_FIELD: 1}, "expireAfterSeconds": int(retention / time.Second)}},
+			}, nil)
+		default:
+			return nil
+		}
+	}
+	if retention <= 0 {
+		return nil
+	}
+	return c.EnsureIndex(mgo.Index{Key: []string{ARCHIVED_FIELD}, ExpireAfter: retention})
+}
+
+// migrateHours converts hours stored as time.String() text into dates. Raw
+// logs written back then had no receive time, so the id's timestamp is used.
+func migrateHours(c *mgo.Collection, setReceived bool) error {
+	var doc struct {
+		ID       bson.ObjectId `bson:"_id"`
+		Hour     string        `bson:"hour"`
+		Received time.Time     `bson:"received"`
+	}
+	migrated := 0
+	iter := c.Find(bson.M{"hour": bson.M{"$type": 2}}).Iter()
+	for iter.Next(&doc) {
+		hour, err := time.Parse(HOUR_STRING_LAYOUT, doc.Hour)
+		if err != nil {
+			logger.Infof("Skipping %s with unreadable hour %q", doc.ID.Hex(), doc.Hour)
+			continue
+		}
+		update := bson.M{"hour": hour.UTC()}
+		if setReceived && doc.Received.IsZero() {
+			update["received"] = doc.ID.Time().UTC()
+		}
+		err = c.UpdateId(doc.ID, bson.M{"$set": update})
+		if mgo.IsDup(err) {
+			err = mergeRollup(c, doc.ID, hour.UTC())
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		migrated++
+	}
+	logger.Infof("Migrated %d documents in %s", migrated, c.FullName)
+	return iter.Close()
+}
+
+// mergeRollup folds a rollup still keyed by a text hour into the one a newer
+// worker already upserted for the same hour, username and metric.
+func mergeRollup(c *mgo.Collection, id bson.ObjectId, hour time.Time) error {
+	var r Rollup
+	err := c.FindId(id).Select(bson.M{"hour": 0}).One(&r)
+	if err != nil {
+		return err
+	}
+	r.Hour = hour
+	if err := upsertRollup(c, &r); err != nil {
+		return err
+	}
+	return c.RemoveId(id)
+}
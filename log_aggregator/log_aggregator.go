@@ -1,125 +1,276 @@
-package main
+package log_aggregator
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"sync"
 	"time"
 
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/config"
 	"github.com/arvindram03/asynch-workers/data"
-	"github.com/arvindram03/asynch-workers/rabbitmq"
-	"github.com/robfig/config"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/pool"
+	"github.com/arvindram03/asynch-workers/scheduler"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
 var (
-	Config *config.Config
-	ENV    string
+	Config   *config.Config
+	ENV      string
+	Settings config.Settings
+
+	// Required lists the options the worker cannot start without.
+	Required = []string{"exchange", "logq", "mongo-url", "mongo-db-name", "mongo-collection-name"}
+
+	// mongoSession is the worker's connection, which a reload changing
+	// mongo-url swaps. Writes and jobs run on copies of it.
+	sessionLock  sync.RWMutex
+	mongoSession *mgo.Session
 )
 
-type Log struct {
-	ID      bson.ObjectId `bson:"_id,omitempty"`
-	Hour    string
-	Metrics data.Metric
-}
+const (
+	// HOUR_STRING_LAYOUT is how time.String() rendered hours before they
+	// were stored as dates.
+	HOUR_STRING_LAYOUT   = "2006-01-02 15:04:05 -0700 MST"
+	SCHEDULER_COLLECTION = "scheduler"
+)
 
-func loadConfig() (err error) {
-	Config, err = config.ReadDefault("../app.conf")
-	if err != nil {
-		log.Fatalf("Failed to read configs. ERR: %+v", err)
-	}
-	return err
+type Log struct {
+	ID       bson.ObjectId `bson:"_id,omitempty"`
+	Hour     time.Time
+	Received time.Time
+	Metrics  data.Metric
 }
 
-func setENV() {
-	ENV = "DEV"
+func setConfig(conf *config.Config) {
+	Config = conf
+	ENV = conf.Env
+	Settings = conf.Settings()
 }
 
 func initMongoDB() (*mgo.Session, error) {
-	mongoURL, _ := Config.String(ENV, "mongo-url")
+	mongoURL := Settings.MongoURL
 	return mgo.Dial(mongoURL)
 
 }
-func getHour(t time.Time) string {
-	time := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC)
-	return time.String()
+
+func currentSession() *mgo.Session {
+	sessionLock.RLock()
+	defer sessionLock.RUnlock()
+	return mongoSession
 }
-func processLog(metric data.Metric, session *mgo.Session) error {
-	hour := getHour(time.Now().UTC())
-	metricLog := &Log{Hour: hour, Metrics: metric}
 
-	mongoDBName, _ := Config.String(ENV, "mongo-db-name")
-	mongoCollectionName, _ := Config.String(ENV, "mongo-collection-name")
-	c := session.DB(mongoDBName).C(mongoCollectionName)
+// copySession copies the current session for a batch or a job, which closes
+// the copy when done.
+func copySession() *mgo.Session {
+	return currentSession().Copy()
+}
 
-	err := c.Insert(metricLog)
+// redialMongo swaps in a session dialed to mongoURL. The copies of the
+// previous session keep it open until they are closed.
+func redialMongo(mongoURL string) error {
+	next, err := mgo.Dial(mongoURL)
 	if err != nil {
-		log.Fatalf("Failed to insert log. ERR: %+v", err)
+		return err
 	}
-	log.Printf("Metric %+v", metric)
-	return err
+	sessionLock.Lock()
+	previous := mongoSession
+	mongoSession = next
+	sessionLock.Unlock()
+	previous.Close()
+	return nil
+}
+func getHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC)
 }
 
-func main() {
-	setENV()
-	loadConfig()
-	rabbitmqUrl, _ := Config.String(ENV, "rabbitmq-url")
-	conn, err := rabbitmq.Dial(rabbitmqUrl)
-	if err != nil {
-		log.Fatalf("Failed to get connection. ERR: %+v", err)
+func newLog(metric data.Metric) *Log {
+	now := time.Now().UTC()
+	return &Log{Hour: getHour(now), Received: now, Metrics: metric}
+}
+
+// watchConfig applies reloaded batching and retry settings and redials
+// MongoDB. The collections and archive options need a restart.
+func watchConfig(writer *batchWriter, archival *scheduler.Scheduler) {
+	reloader := config.NewReloader(Config, "log-batch-size", "log-batch-interval-ms", "retry-count", "mongo-url")
+	reloader.Validate = func(next *config.Config) error {
+		if err := next.AtLeast(0, "retry-count"); err != nil {
+			return err
+		}
+		return next.AtLeast(1, "log-batch-size", "log-batch-interval-ms")
+	}
+	reloader.Apply = func(next *config.Config, changed []string) {
+		if len(config.Changed(changed, "mongo-url")) > 0 {
+			if err := redialMongo(next.Settings().MongoURL); err != nil {
+				logger.Errorf("Failed to redial mongodb, keeping the current session. ERR: %s", config.Redact(err.Error()))
+			}
+		}
+		if len(config.Changed(changed, "log-batch-size", "log-batch-interval-ms", "retry-count")) == 0 {
+			return
+		}
+		batchSize, _ := next.Int(ENV, "log-batch-size")
+		batchInterval, _ := next.Int(ENV, "log-batch-interval-ms")
+		retryCount := next.Settings().RetryCount
+		writer.reconfigure(batchSettings{
+			size:       batchSize,
+			interval:   time.Duration(batchInterval) * time.Millisecond,
+			retryCount: retryCount,
+		})
+		archival.SetRetry(ARCHIVE_JOB, scheduler.RetryPolicy{Attempts: retryCount, Backoff: 2 * time.Second})
 	}
-	defer conn.Close()
+	reloader.Start(Config)
+}
 
-	ch, err := rabbitmq.Channel(conn)
-	if err != nil {
-		log.Fatalf("Failed to open channel. ERR: %+v", err)
+// adapt sizes the batches from 1 up to batchSize, the write latency of a
+// batch growing with it. The prefetch is kept at two batches so the next
+// one fills while one is written.
+func adapt(writer *batchWriter, options config.Adaptive, b broker.Broker, batchSize int) {
+	a := &pool.Adaptive{
+		Min:      1,
+		Max:      batchSize,
+		Step:     batchSize / 10,
+		Target:   options.TargetLatency,
+		Interval: options.Interval,
+		Latency:  &writer.latency,
+		Depth:    func() (int, error) { return b.Depth(Settings.LogQ) },
+		Apply: func(size int) {
+			writer.setLimit(size)
+			if err := b.SetPrefetch(Settings.LogQ, 2*size); err != nil {
+				logger.Errorf("Failed to set the prefetch of %s. ERR: %+v", Settings.LogQ, err)
+			}
+		},
 	}
+	a.Start(batchSize)
+}
+
+// collections are what the worker and its commands use. raw and rollups are
+// nil when turned off; logs is the configured collection either way.
+type collections struct {
+	db      *mgo.Database
+	logs    *mgo.Collection
+	raw     *mgo.Collection
+	rollups *mgo.Collection
+}
+
+func openCollections(session *mgo.Session) *collections {
+	rollup, _ := Config.Bool(ENV, "log-rollup")
+	rawCapture, _ := Config.Bool(ENV, "log-raw-capture")
+	db := session.DB(Settings.MongoDBName)
+	c := &collections{db: db, logs: db.C(Settings.MongoCollectionName)}
 
-	defer ch.Close()
-	exchange, _ := Config.String(ENV, "exchange")
-	err = rabbitmq.Exchange(exchange, ch)
+	// With rollups on, raw documents are only kept when capture is asked for.
+	if rawCapture || !rollup {
+		c.raw = c.logs
+	}
+	if rollup {
+		rollupCollectionName, _ := Config.String(ENV, "mongo-rollup-collection-name")
+		c.rollups = db.C(rollupCollectionName)
+	}
+	retentionDays, _ := Config.Int(ENV, "log-retention-days")
+	err := ensureIndexes(c.raw, c.rollups, time.Duration(retentionDays)*24*time.Hour)
 	if err != nil {
-		log.Fatalf("Failed to declare an exchange. ERR: %+v", err)
+		logger.Fatalf("Failed to ensure indexes. ERR: %+v", err)
 	}
+	return c
+}
 
-	logq, _ := Config.String(ENV, "logq")
-	q, err := rabbitmq.Queue(logq, ch)
+func connect(conf *config.Config) (*mgo.Session, *collections) {
+	setConfig(conf)
+	session, err := initMongoDB()
 	if err != nil {
-		log.Fatalf("Failed to declare a queue. ERR: %+v", err)
+		logger.Fatalf("Failed to start mongodb connection. ERR: %s", config.Redact(err.Error()))
 	}
+	return session, openCollections(session)
+}
 
-	err = rabbitmq.QueueBind(q, exchange, ch)
+// MigrateHours converts hours stored as text into dates.
+func MigrateHours(conf *config.Config) {
+	session, c := connect(conf)
+	defer session.Close()
+	err := migrateHours(c.logs, true)
+	if err == nil && c.rollups != nil {
+		err = migrateHours(c.rollups, false)
+	}
 	if err != nil {
-		log.Fatalf("Failed to bind. ERR: %+v", err)
+		logger.Fatalf("Failed to migrate hours. ERR: %+v", err)
 	}
+}
+
+// Archive runs the archive subcommand.
+func Archive(conf *config.Config) {
+	session, c := connect(conf)
+	defer session.Close()
+	archiveDir, _ := Config.String(ENV, "archive-dir")
+	runArchiveCommand(c.logs, archiveDir)
+}
+
+// Restore runs the restore subcommand with its arguments.
+func Restore(conf *config.Config, args []string) {
+	session, c := connect(conf)
+	defer session.Close()
+	runRestoreCommand(c.db, args)
+}
+
+// Run stores every log, batched, until the process exits and archives the
+// days that close meanwhile.
+func Run(conf *config.Config, b broker.Broker) {
+	session, c := connect(conf)
+	sessionLock.Lock()
+	mongoSession = session
+	sessionLock.Unlock()
+	defer func() { currentSession().Close() }()
+
+	batchSize, _ := Config.Int(ENV, "log-batch-size")
+	batchInterval, _ := Config.Int(ENV, "log-batch-interval-ms")
+	retryCount := Settings.RetryCount
+	archiveDir, _ := Config.String(ENV, "archive-dir")
 
-	msgs, err := rabbitmq.Consume(q, ch)
+	writer := newBatchWriter(
+		c.raw,
+		c.rollups,
+		batchSize,
+		time.Duration(batchInterval)*time.Millisecond,
+		retryCount,
+	)
+	writer.session = copySession
+	// The probe refreshes the session, dropping the sockets that broke.
+	writer.store = circuit.Configured(Config, "mongodb", func() error {
+		session := currentSession()
+		session.Refresh()
+		return session.Ping()
+	})
+	writer.pause = func() { b.Cancel(Settings.LogQ) }
+	deadLetter, _ := Config.String(ENV, "dead-letter-exchange")
+	settler, err := fault.NewSettler(b, Settings.LogQ, deadLetter)
 	if err != nil {
-		log.Fatalf("Failed to register name collector. ERR: %+v", err)
+		logger.Fatalf("Failed to declare the dead letters of %s. ERR: %s", Settings.LogQ, config.Redact(err.Error()))
 	}
+	writer.settler = settler
 
-	session, err := initMongoDB()
-	if err != nil {
-		log.Fatalf("Failed to start mongodb connection. ERR: %+v", err)
+	archival := scheduleArchival(c.db, c.logs, archiveDir)
+	watchConfig(writer, archival)
+	if adaptive := Config.Adaptive(); adaptive.On {
+		adapt(writer, adaptive, b, batchSize)
 	}
-	defer session.Close()
+
 	forever := make(chan bool)
+	// Consumption stops while MongoDB is down and resumes once the breaker
+	// closes.
 	go func() {
-		for d := range msgs {
-			var metric data.Metric
-			err := json.Unmarshal(d.Body, &metric)
-			if err != nil {
-				log.Fatalf("Error unmarshalling metric. ERR: %+v", err)
-			}
-			err = processLog(metric, session)
+		for {
+			msgs, err := b.Consume(Settings.Exchange, Settings.LogQ, Settings.LogQBindings)
 			if err != nil {
-				d.Nack(true, true)
+				logger.Errorf("Failed to register name collector. ERR: %s", config.Redact(err.Error()))
+				time.Sleep(time.Second)
+				continue
 			}
-			d.Ack(false)
+			writer.run(msgs)
+			writer.store.Wait()
+			logger.Infof("Resuming %s", Settings.LogQ)
 		}
-		fmt.Println("end")
 	}()
-	log.Printf("Waiting for metrics....")
+	logger.Infof("Waiting for metrics....")
 	<-forever
 }
@@ -0,0 +1,63 @@
+package log_aggregator
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Rollup accumulates every metric a user sent during an hour.
+type Rollup struct {
+	Hour     time.Time `bson:"hour"`
+	Username string    `bson:"username"`
+	Metric   string    `bson:"metric"`
+	Count    int64     `bson:"count"`
+	Events   int64     `bson:"events"`
+	First    time.Time `bson:"first"`
+	Last     time.Time `bson:"last"`
+}
+
+type rollupKey struct {
+	hour             time.Time
+	username, metric string
+}
+
+func rollupKeyOf(e entry) rollupKey {
+	return rollupKey{e.log.Hour, e.log.Metrics.Username, e.log.Metrics.Metric}
+}
+
+// rollupBatch folds a batch into one Rollup per (hour, username, metric).
+func rollupBatch(entries []entry) map[rollupKey]*Rollup {
+	rollups := map[rollupKey]*Rollup{}
+	for _, e := range entries {
+		metric := e.log.Metrics
+		key := rollupKeyOf(e)
+		r, ok := rollups[key]
+		if !ok {
+			r = &Rollup{Hour: key.hour, Username: key.username, Metric: key.metric, First: e.received, Last: e.received}
+			rollups[key] = r
+		}
+		r.Count += metric.Count
+		r.Events++
+		if e.received.Before(r.First) {
+			r.First = e.received
+		}
+		if e.received.After(r.Last) {
+			r.Last = e.received
+		}
+	}
+	return rollups
+}
+
+func upsertRollup(c *mgo.Collection, r *Rollup) error {
+	_, err := c.Upsert(
+		bson.M{"hour": r.Hour, "username": r.Username, "metric": r.Metric},
+		bson.M{
+			"$inc": bson.M{"count": r.Count, "events": r.Events},
+			"$min": bson.M{"first": r.First},
+			"$max": bson.M{"last": r.Last},
+		},
+	)
+	return err
+}
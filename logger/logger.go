@@ -0,0 +1,180 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+	FATAL
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel reads a log-level option.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level %q, use one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Fields are what a line is about, written next to its message.
+type Fields map[string]interface{}
+
+// Logger writes a JSON object per line: time, level, msg and its fields.
+type Logger struct {
+	fields Fields
+}
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = INFO
+	std             = &Logger{}
+)
+
+// SetLevel drops the lines below min.
+func SetLevel(min Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = min
+}
+
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+func With(fields Fields) *Logger {
+	return std.With(fields)
+}
+
+// With returns a Logger adding fields to every line.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+// ForDelivery tags the lines about a delivery of queue with the request it
+// came from.
+func ForDelivery(queue string, d amqp.Delivery) *Logger {
+	return std.With(Fields{
+		"request_id":   d.CorrelationId,
+		"queue":        queue,
+		"delivery_tag": d.DeliveryTag,
+		"redelivered":  d.Redelivered,
+	})
+}
+
+// MetricFields are a metric as log fields. They take the metric's values
+// rather than the metric, so the data package stays free of imports.
+func MetricFields(username string, metric string, count int64) Fields {
+	return Fields{"username": username, "metric": metric, "count": count}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log(DEBUG, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log(INFO, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log(WARN, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log(ERROR, format, args) }
+
+// Fatalf logs and exits the process.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(FATAL, format, args)
+	os.Exit(1)
+}
+
+func Debugf(format string, args ...interface{}) { std.log(DEBUG, format, args) }
+func Infof(format string, args ...interface{})  { std.log(INFO, format, args) }
+func Warnf(format string, args ...interface{})  { std.log(WARN, format, args) }
+func Errorf(format string, args ...interface{}) { std.log(ERROR, format, args) }
+
+func Fatalf(format string, args ...interface{}) {
+	std.log(FATAL, format, args)
+	os.Exit(1)
+}
+
+func (l *Logger) log(at Level, format string, args []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if at < level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeJSON(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeJSON(&line, at.String())
+	line.WriteString(`,"msg":`)
+	writeJSON(&line, msg)
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		line.WriteString(",")
+		writeJSON(&line, k)
+		line.WriteString(":")
+		writeJSON(&line, l.fields[k])
+	}
+	line.WriteString("}\n")
+	out.Write(line.Bytes())
+}
+
+// writeJSON writes value, errors and other values JSON cannot encode as
+// their text.
+func writeJSON(line *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+// Writer logs every line written to it at level, for packages logging
+// through the standard log package.
+func Writer(at Level) io.Writer {
+	return writer(at)
+}
+
+type writer Level
+
+func (w writer) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		std.log(Level(w), "%s", []interface{}{line})
+	}
+	return len(p), nil
+}
@@ -1,101 +1,310 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/arvindram03/asynch-workers/data"
-	"github.com/arvindram03/asynch-workers/rabbitmq"
-	"github.com/robfig/config"
+	"github.com/arvindram03/asynch-workers/account_aggregator"
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/circuit"
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/event_aggregator"
+	"github.com/arvindram03/asynch-workers/export"
+	"github.com/arvindram03/asynch-workers/log_aggregator"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/pool"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/arvindram03/asynch-workers/server"
 )
 
-const (
-	POST = "POST"
-)
+const USAGE = `Usage: asynch-workers [-env ENV] [-config FILE] <command>
 
-var (
-	Config *config.Config
-	ENV    string
-)
+Commands:
+  serve                          run the HTTP server
+  dev [-workers account,event,log]
+                                 run the server and workers in one process over an in-memory broker
+  worker account|event|log       consume metrics into postgres, redis or mongodb
+  curate -from YYYY-MM [-to YYYY-MM] [-apply]
+                                 re-run the curation of past months
+  migrate keys|hours             rewrite redis keys or mongodb hours of earlier versions
+  admin archive                  archive every closed day of logs
+  admin restore -manifest FILE [-collection NAME]
+                                 restore an archived day
+  admin export -source accounts|events|logs [...]
+                                 export a data set
+  admin config                   print the resolved config with secrets masked
+`
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Hello Gophers :)")
+func usage() {
+	fmt.Fprint(os.Stderr, USAGE)
+	flag.PrintDefaults()
+	os.Exit(2)
 }
 
-func metricHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != POST {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	rabbitmqUrl, _ := Config.String(ENV, "rabbitmq-url")
-	conn, err := rabbitmq.Dial(rabbitmqUrl)
+func init() {
+	// Lines of the libraries logging through the standard log package.
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logger.INFO))
+}
+
+func loadConfig(required []string) *config.Config {
+	conf, err := config.Load(required...)
 	if err != nil {
-		log.Fatalf("Failed to get connection. ERR: %+v", err)
+		logger.Fatalf("Failed to read configs. ERR: %s", config.Redact(err.Error()))
+	}
+	if name, err := conf.String(conf.Env, "log-level"); err == nil {
+		level, err := logger.ParseLevel(name)
+		if err != nil {
+			logger.Fatalf("Failed to read log-level. ERR: %+v", err)
+		}
+		logger.SetLevel(level)
 	}
-	defer conn.Close()
+	logger.Infof("Config %s", conf.Redacted())
+	return conf
+}
 
-	ch, err := rabbitmq.Channel(conn)
-	if err != nil {
-		log.Fatalf("Failed to open channel. ERR: %+v", err)
+func exchangeKind(conf *config.Config) string {
+	kind := conf.Settings().ExchangeType
+	if kind != "" && kind != broker.FANOUT && kind != broker.TOPIC {
+		logger.Fatalf("Unknown exchange-type %q, use %s or %s", kind, broker.FANOUT, broker.TOPIC)
 	}
-	defer ch.Close()
-	ch.Confirm(false)
+	return kind
+}
 
-	ack, nack := rabbitmq.GetAckNack(ch)
-	exchange, _ := Config.String(ENV, "exchange")
-	err = rabbitmq.Exchange(exchange, ch)
-	if err != nil {
-		log.Fatalf("Failed to declare an exchange. ERR: %+v", err)
+// newBroker connects to the backend named by the broker option, RabbitMQ
+// unless it is redis. url reads rabbitmq-url whenever RabbitMQ is dialed; a
+// reload changing it or the redis options redials the connections.
+func newBroker(conf *config.Config, url func() (string, error)) broker.Broker {
+	backend, _ := conf.String(conf.Env, "broker")
+	kind := exchangeKind(conf)
+	prefetch := conf.Settings().Prefetch
+	switch backend {
+	case "", broker.RABBITMQ:
+		if _, err := conf.String(conf.Env, "rabbitmq-url"); err != nil {
+			logger.Fatalf("Failed to configure rabbitmq. ERR: %s", config.Redact(err.Error()))
+		}
+		b := broker.NewAMQP(url, kind)
+		b.Prefetch = prefetch
+		config.OnChange(conf, func(next *config.Config, changed []string) {
+			if err := b.Redial(); err != nil {
+				logger.Errorf("Failed to cancel the consumers to redial rabbitmq. ERR: %s", config.Redact(err.Error()))
+			}
+		}, "rabbitmq-url")
+		return b
+	case broker.REDIS:
+		client := redialingRedis(conf)
+		claimAfter, _ := conf.Int(conf.Env, "redis-stream-claim-after-ms")
+		maxLen, _ := conf.Int(conf.Env, "redis-stream-maxlen")
+		b := broker.NewStreams(client, kind, time.Duration(claimAfter)*time.Millisecond, int64(maxLen))
+		b.Prefetch = prefetch
+		return b
 	}
+	logger.Fatalf("Unknown broker %q, use %s or %s", backend, broker.RABBITMQ, broker.REDIS)
+	return nil
+}
 
-	decoder := json.NewDecoder(r.Body)
-	var metric data.Metric
-	err = decoder.Decode(&metric)
+// redialingRedis makes a client from the redis options that a reload
+// changing them redials.
+func redialingRedis(conf *config.Config) redisclient.Client {
+	client, err := redisclient.New(conf, conf.Env)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		logger.Fatalf("Failed to configure redis. ERR: %s", config.Redact(err.Error()))
 	}
+	swappable := redisclient.NewSwappable(client)
+	config.OnChange(conf, func(next *config.Config, changed []string) {
+		if err := swappable.Redial(next, next.Env); err != nil {
+			logger.Errorf("Failed to redial redis, keeping the current connection. ERR: %s", config.Redact(err.Error()))
+		}
+	}, redisclient.ConnectionOptions...)
+	return swappable
+}
 
-	metricJson, err := json.Marshal(metric)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// workerBroker is the broker of a worker, which reads rabbitmq-url from the
+// latest config.
+func workerBroker(conf *config.Config) broker.Broker {
+	var mu sync.Mutex
+	current := conf
+	config.OnChange(conf, func(next *config.Config, changed []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = next
+	}, "rabbitmq-url")
+	return sharded(conf, newBroker(conf, func() (string, error) {
+		mu.Lock()
+		c := current
+		mu.Unlock()
+		return c.String(c.Env, "rabbitmq-url")
+	}))
+}
+
+// sharded splits the worker queues into routing-shards queues when
+// shard-queues is set, so that each username is handled by one replica.
+func sharded(conf *config.Config, b broker.Broker) broker.Broker {
+	if on, _ := conf.Bool(conf.Env, "shard-queues"); !on {
+		return b
 	}
-	err = rabbitmq.PublishJson(metricJson, exchange, ch)
-	if err != nil {
-		log.Fatalf("Failed to publish message. ERR: %+v", err)
+	settings := conf.Settings()
+	if settings.ExchangeType != broker.TOPIC {
+		logger.Fatalf("shard-queues needs exchange-type %s", broker.TOPIC)
 	}
-
-	select {
-	case <-ack:
-		log.Printf("Pushed. Metric: %+v\n", metric)
-		w.WriteHeader(http.StatusOK)
-	case <-nack:
-		log.Printf("Failed tp push. Metric: %+v\n", metric)
-		w.WriteHeader(http.StatusInternalServerError)
+	if settings.RoutingShards < 1 {
+		logger.Fatalf("shard-queues needs routing-shards of at least 1")
 	}
-
+	client := redialingRedis(conf)
+	heartbeat, _ := conf.Int(conf.Env, "shard-heartbeat-ms")
+	return broker.NewSharded(b, client, settings.RoutingShards, time.Duration(heartbeat)*time.Millisecond)
 }
 
-func setENV() {
-	ENV = "DEV"
+// serveAdmin serves the worker's handler pools and health on admin-addr,
+// when set.
+func serveAdmin(conf *config.Config) {
+	addr, _ := conf.String(conf.Env, "admin-addr")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/admin/pools", pool.Admin)
+	mux.Handle("/health", circuit.Health)
+	go func() {
+		logger.Infof("Admin listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorf("Failed to serve admin. ERR: %+v", err)
+		}
+	}()
 }
 
-func loadConfig() {
-	var err error
-	Config, err = config.ReadDefault("app.conf")
-	if err != nil {
-		log.Fatalf("Error loading config. ERR: %+v", err)
+// runDev runs the server and the chosen workers in this process. Metrics go
+// through an in-memory broker, so RabbitMQ is not needed, but the workers
+// still write to PostgreSQL, Redis and MongoDB.
+func runDev(args []string) {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	workers := fs.String("workers", "account,event,log", "comma separated workers to run")
+	fs.Parse(args)
+
+	runners := map[string]func(*config.Config, broker.Broker){
+		"account": account_aggregator.Run,
+		"event":   event_aggregator.Run,
+		"log":     log_aggregator.Run,
 	}
+	required := append([]string{}, server.Required...)
+	requires := map[string][]string{
+		"account": account_aggregator.Required,
+		"event":   event_aggregator.Required,
+		"log":     log_aggregator.Required,
+	}
+	var names []string
+	for _, name := range strings.Split(*workers, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if runners[name] == nil {
+			fmt.Fprintf(os.Stderr, "dev: unknown worker %q\n", name)
+			os.Exit(2)
+		}
+		names = append(names, name)
+		required = append(required, requires[name]...)
+	}
+	conf := loadConfig(required)
+	settings := conf.Settings()
+
+	memory := broker.NewMemory(exchangeKind(conf))
+	memory.Prefetch = settings.Prefetch
+	b := sharded(conf, memory)
+	defer b.Close()
+	queues := map[string]string{"account": settings.AccQ, "event": settings.NameQ, "log": settings.LogQ}
+	bindings := map[string][]string{"account": settings.AccQBindings, "event": settings.NameQBindings, "log": settings.LogQBindings}
+	for _, name := range names {
+		// Declared before the server starts so no metric is dropped while
+		// the workers connect.
+		if err := b.Declare(settings.Exchange, queues[name], bindings[name]); err != nil {
+			logger.Fatalf("Failed to declare %s. ERR: %+v", queues[name], err)
+		}
+		go runners[name](conf, b)
+	}
+	// The pools and the workers' health are served on the server's port.
+	http.Handle("/admin/pools", pool.Admin)
+	http.Handle("/health", circuit.Health)
+	server.Run(conf, b)
 }
 
 func main() {
-	setENV()
-	loadConfig()
-	http.HandleFunc("/metric", metricHandler)
-	http.HandleFunc("/", handler)
-	fmt.Println("Listening on 6055...")
-	http.ListenAndServe(":6055", nil)
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	command, arg := args[0], ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+
+	switch command {
+	case "serve":
+		conf := loadConfig(server.Required)
+		b := newBroker(conf, server.RabbitMQURL)
+		defer b.Close()
+		server.Run(conf, b)
+	case "dev":
+		runDev(args[1:])
+	case "worker":
+		switch arg {
+		case "account":
+			conf := loadConfig(account_aggregator.Required)
+			serveAdmin(conf)
+			b := workerBroker(conf)
+			defer b.Close()
+			account_aggregator.Run(conf, b)
+		case "event":
+			conf := loadConfig(event_aggregator.Required)
+			serveAdmin(conf)
+			b := workerBroker(conf)
+			defer b.Close()
+			event_aggregator.Run(conf, b)
+		case "log":
+			conf := loadConfig(log_aggregator.Required)
+			serveAdmin(conf)
+			b := workerBroker(conf)
+			defer b.Close()
+			log_aggregator.Run(conf, b)
+		default:
+			usage()
+		}
+	case event_aggregator.CURATE_COMMAND:
+		event_aggregator.Curate(loadConfig(nil), args[1:])
+	case "migrate":
+		switch arg {
+		case "keys":
+			event_aggregator.MigrateKeys(loadConfig(nil))
+		case "hours":
+			log_aggregator.MigrateHours(loadConfig([]string{"mongo-url", "mongo-db-name", "mongo-collection-name"}))
+		default:
+			usage()
+		}
+	case "admin":
+		switch arg {
+		case log_aggregator.ARCHIVE_COMMAND:
+			log_aggregator.Archive(loadConfig([]string{"mongo-url", "mongo-db-name", "mongo-collection-name"}))
+		case log_aggregator.RESTORE_COMMAND:
+			log_aggregator.Restore(loadConfig([]string{"mongo-url", "mongo-db-name"}), args[2:])
+		case export.COMMAND:
+			export.Run(loadConfig(nil), args[2:])
+		case "config":
+			conf, err := config.Load()
+			if err != nil {
+				logger.Fatalf("Failed to read configs. ERR: %s", config.Redact(err.Error()))
+			}
+			fmt.Println(conf.Redacted())
+		default:
+			usage()
+		}
+	default:
+		usage()
+	}
 }
@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+const DEFAULT_ADJUST_INTERVAL = 5 * time.Second
+
+// Meter averages the durations recorded since it was last read.
+type Meter struct {
+	mu    sync.Mutex
+	count int
+	total time.Duration
+}
+
+func (m *Meter) Record(d time.Duration) {
+	m.mu.Lock()
+	m.count++
+	m.total += d
+	m.mu.Unlock()
+}
+
+// Mean returns the average since the last call and starts over, 0 when
+// nothing was recorded.
+func (m *Meter) Mean() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.count == 0 {
+		return 0
+	}
+	mean := m.total / time.Duration(m.count)
+	m.count, m.total = 0, 0
+	return mean
+}
+
+// Adaptive sizes a worker every Interval, AIMD style. When the mean Latency
+// of the last interval is above Target the store is struggling, so the size
+// is halved. Otherwise it grows by Step while the queue is deeper than at the
+// last look, and gives a Step back once the queue is empty. The size stays
+// between Min and Max and Apply puts it to use. A Target of 0 ignores the
+// latency.
+type Adaptive struct {
+	Min      int
+	Max      int
+	Step     int
+	Target   time.Duration
+	Interval time.Duration
+	Latency  *Meter
+	Depth    func() (int, error)
+	Apply    func(size int)
+
+	size  int
+	depth int
+}
+
+// Start adjusts from size onwards until the process exits.
+func (a *Adaptive) Start(size int) {
+	if a.Step < 1 {
+		a.Step = 1
+	}
+	if a.Interval <= 0 {
+		a.Interval = DEFAULT_ADJUST_INTERVAL
+	}
+	a.size = a.bound(size)
+	a.Apply(a.size)
+	go func() {
+		for range time.Tick(a.Interval) {
+			depth, err := a.Depth()
+			if err != nil {
+				logger.Errorf("Failed to read the queue depth. ERR: %+v", err)
+				continue
+			}
+			latency := a.Latency.Mean()
+			if size := a.adjust(latency, depth); size != a.size {
+				logger.Infof("Resizing from %d to %d, queue depth %d, latency %s", a.size, size, depth, latency)
+				a.size = size
+				a.Apply(size)
+			}
+		}
+	}()
+}
+
+func (a *Adaptive) adjust(latency time.Duration, depth int) int {
+	last := a.depth
+	a.depth = depth
+	switch {
+	case a.Target > 0 && latency > a.Target:
+		return a.bound(a.size / 2)
+	case depth > 0 && depth >= last:
+		return a.bound(a.size + a.Step)
+	case depth == 0:
+		return a.bound(a.size - a.Step)
+	}
+	return a.size
+}
+
+func (a *Adaptive) bound(size int) int {
+	if size > a.Max {
+		size = a.Max
+	}
+	if size < a.Min {
+		size = a.Min
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// Adapt sizes p within options and prefetches PrefetchPerHandler deliveries
+// of queue on b for each handler.
+func (p *Pool) Adapt(options config.Adaptive, b broker.Broker, queue string) {
+	a := &Adaptive{
+		Min:      options.MinHandlers,
+		Max:      options.MaxHandlers,
+		Target:   options.TargetLatency,
+		Interval: options.Interval,
+		Latency:  &p.Latency,
+		Depth:    func() (int, error) { return b.Depth(queue) },
+		Apply: func(size int) {
+			p.Resize(size)
+			if options.PrefetchPerHandler <= 0 {
+				return
+			}
+			if err := b.SetPrefetch(queue, size*options.PrefetchPerHandler); err != nil {
+				logger.Errorf("Failed to set the prefetch of %s. ERR: %+v", queue, err)
+			}
+		},
+	}
+	a.Start(p.Size())
+}
@@ -0,0 +1,58 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdjust(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int
+		lastDepth int
+		latency   time.Duration
+		depth     int
+		want      int
+	}{
+		{"slow store halves", 8, 0, 300 * time.Millisecond, 100, 4},
+		{"slow store stops at min", 3, 0, 300 * time.Millisecond, 100, 2},
+		{"growing queue grows", 4, 10, 10 * time.Millisecond, 20, 5},
+		{"steady queue grows", 4, 10, 10 * time.Millisecond, 10, 5},
+		{"growing queue stops at max", 10, 10, 10 * time.Millisecond, 20, 10},
+		{"shrinking queue holds", 4, 20, 10 * time.Millisecond, 10, 4},
+		{"empty queue shrinks", 4, 20, 10 * time.Millisecond, 0, 3},
+		{"empty queue stops at min", 2, 0, 0, 0, 2},
+		{"idle store grows", 4, 0, 0, 5, 5},
+	}
+	for _, c := range cases {
+		a := &Adaptive{Min: 2, Max: 10, Step: 1, Target: 100 * time.Millisecond, size: c.size, depth: c.lastDepth}
+		if got := a.adjust(c.latency, c.depth); got != c.want {
+			t.Errorf("%s: adjust(%s, %d) from %d = %d, want %d", c.name, c.latency, c.depth, c.size, got, c.want)
+		}
+		if a.depth != c.depth {
+			t.Errorf("%s: remembered depth %d, want %d", c.name, a.depth, c.depth)
+		}
+	}
+}
+
+func TestAdjustWithoutTarget(t *testing.T) {
+	a := &Adaptive{Min: 1, Max: 10, Step: 2, size: 4}
+	if got := a.adjust(time.Hour, 10); got != 6 {
+		t.Errorf("adjust ignoring latency = %d, want 6", got)
+	}
+}
+
+func TestMeterMean(t *testing.T) {
+	var m Meter
+	if got := m.Mean(); got != 0 {
+		t.Errorf("Mean of nothing = %s, want 0", got)
+	}
+	m.Record(10 * time.Millisecond)
+	m.Record(30 * time.Millisecond)
+	if got := m.Mean(); got != 20*time.Millisecond {
+		t.Errorf("Mean = %s, want 20ms", got)
+	}
+	if got := m.Mean(); got != 0 {
+		t.Errorf("Mean after reading = %s, want 0", got)
+	}
+}
@@ -0,0 +1,79 @@
+package pool
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+var registry = struct {
+	sync.Mutex
+	pools map[string]*Pool
+}{pools: map[string]*Pool{}}
+
+// Register makes p resizable through Admin under name, usually its queue.
+func Register(name string, p *Pool) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.pools[name] = p
+}
+
+func lookup(name string) *Pool {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.pools[name]
+}
+
+type status struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Busy int    `json:"busy"`
+}
+
+func statuses() []status {
+	registry.Lock()
+	defer registry.Unlock()
+	var names []string
+	for name := range registry.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []status{}
+	for _, name := range names {
+		p := registry.pools[name]
+		list = append(list, status{Name: name, Size: p.Size(), Busy: p.Busy()})
+	}
+	return list
+}
+
+// Admin serves GET /admin/pools, listing the registered pools, and
+// POST /admin/pools?name=accq&size=8, resizing one.
+var Admin = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		p := lookup(r.FormValue("name"))
+		if p == nil {
+			http.Error(w, "unknown pool", http.StatusNotFound)
+			return
+		}
+		size, err := strconv.Atoi(r.FormValue("size"))
+		if err == nil {
+			err = p.Resize(size)
+		}
+		if err != nil {
+			http.Error(w, "size must be a number of at least 1", http.StatusBadRequest)
+			return
+		}
+		logger.Infof("Resized %s to %d handlers", r.FormValue("name"), size)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses())
+})
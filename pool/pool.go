@@ -0,0 +1,155 @@
+package pool
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// LANE_BUFFER is how many deliveries wait for each handler of a keyed pool,
+// so a slow key only holds up the others once its lane is full.
+const LANE_BUFFER = 16
+
+// Pool hands deliveries to Size handler goroutines. With a Key, the
+// deliveries of a key always go to the same handler, so they are handled one
+// at a time in the order they arrived; without one any idle handler takes the
+// next delivery. Handlers ack or nack their own delivery, never with multiple
+// set, since the ones before it may still be in other handlers.
+type Pool struct {
+	Key func(amqp.Delivery) string
+	// Latency measures how long the handlers take.
+	Latency Meter
+
+	mu      sync.Mutex
+	size    int
+	busy    int
+	resized chan bool
+}
+
+func New(size int, key func(amqp.Delivery) string) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{Key: key, size: size, resized: make(chan bool, 1)}
+}
+
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Busy is the number of handlers handling a delivery right now.
+func (p *Pool) Busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.busy
+}
+
+// Resize changes the number of handlers. The running handlers finish what
+// was handed to them before the new ones start, so keyed deliveries stay in
+// order.
+func (p *Pool) Resize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("pool size must be at least 1, got %d", size)
+	}
+	p.mu.Lock()
+	p.size = size
+	p.mu.Unlock()
+	select {
+	case p.resized <- true:
+	default:
+	}
+	return nil
+}
+
+// Run handles msgs until the channel closes and the handlers are done.
+func (p *Pool) Run(msgs <-chan amqp.Delivery, handle func(amqp.Delivery)) {
+	for {
+		l := p.start(p.Size(), handle)
+		done := p.dispatch(msgs, l)
+		l.stop()
+		if done {
+			return
+		}
+	}
+}
+
+// dispatch feeds l until msgs closes, which it reports, or the pool is
+// resized.
+func (p *Pool) dispatch(msgs <-chan amqp.Delivery, l *lanes) bool {
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return true
+			}
+			l.send(d)
+		case <-p.resized:
+			if p.Size() != l.size {
+				return false
+			}
+		}
+	}
+}
+
+func (p *Pool) track(delta int) {
+	p.mu.Lock()
+	p.busy += delta
+	p.mu.Unlock()
+}
+
+// lanes are the channels of one generation of handlers: a shared one, or
+// one per handler for a keyed pool.
+type lanes struct {
+	key   func(amqp.Delivery) string
+	size  int
+	chans []chan amqp.Delivery
+	wg    sync.WaitGroup
+}
+
+func (p *Pool) start(size int, handle func(amqp.Delivery)) *lanes {
+	l := &lanes{key: p.Key, size: size}
+	count, buffer := 1, 0
+	if p.Key != nil {
+		count, buffer = size, LANE_BUFFER
+	}
+	for i := 0; i < count; i++ {
+		l.chans = append(l.chans, make(chan amqp.Delivery, buffer))
+	}
+	for i := 0; i < size; i++ {
+		l.wg.Add(1)
+		go func(ch chan amqp.Delivery) {
+			defer l.wg.Done()
+			for d := range ch {
+				p.track(1)
+				start := time.Now()
+				handle(d)
+				p.Latency.Record(time.Since(start))
+				p.track(-1)
+			}
+		}(l.chans[i%count])
+	}
+	return l
+}
+
+func (l *lanes) send(d amqp.Delivery) {
+	ch := l.chans[0]
+	if l.key != nil {
+		h := fnv.New32a()
+		h.Write([]byte(l.key(d)))
+		ch = l.chans[h.Sum32()%uint32(len(l.chans))]
+	}
+	ch <- d
+}
+
+// stop lets the handlers finish what they were handed and waits for them.
+func (l *lanes) stop() {
+	for _, ch := range l.chans {
+		close(ch)
+	}
+	l.wg.Wait()
+}
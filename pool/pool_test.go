@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func byUsername(d amqp.Delivery) string {
+	return d.CorrelationId
+}
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		size    int
+		want    int
+		invalid bool
+	}{
+		{size: 4, want: 4},
+		{size: 1, want: 1},
+		{size: 0, want: 2, invalid: true},
+		{size: -1, want: 2, invalid: true},
+	}
+	for _, c := range cases {
+		p := New(2, nil)
+		err := p.Resize(c.size)
+		if (err != nil) != c.invalid {
+			t.Errorf("Resize(%d) error %v, want an error: %v", c.size, err, c.invalid)
+		}
+		if got := p.Size(); got != c.want {
+			t.Errorf("Resize(%d) left size %d, want %d", c.size, got, c.want)
+		}
+	}
+	if got := New(0, nil).Size(); got != 1 {
+		t.Errorf("New(0) has size %d, want 1", got)
+	}
+}
+
+// The deliveries of a key are handled one at a time and in order, across
+// resizes, while the handlers of other keys run alongside.
+func TestKeyedOrder(t *testing.T) {
+	cases := []struct {
+		size int
+		// resizes are the sizes set before the delivery numbered by the key.
+		resizes map[int]int
+	}{
+		{1, nil},
+		{4, nil},
+		{4, map[int]int{50: 1, 100: 8, 150: 2}},
+	}
+	const keys, perKey = 5, 200
+	for _, c := range cases {
+		p := New(c.size, byUsername)
+		msgs := make(chan amqp.Delivery)
+		var (
+			mu       sync.Mutex
+			handled  = map[string][]int{}
+			inFlight = map[string]bool{}
+		)
+		done := make(chan bool)
+		go func() {
+			p.Run(msgs, func(d amqp.Delivery) {
+				key := byUsername(d)
+				mu.Lock()
+				if inFlight[key] {
+					t.Errorf("size %d: two deliveries of %s at once", c.size, key)
+				}
+				inFlight[key] = true
+				mu.Unlock()
+				time.Sleep(10 * time.Microsecond)
+				seq, _ := strconv.Atoi(string(d.Body))
+				mu.Lock()
+				inFlight[key] = false
+				handled[key] = append(handled[key], seq)
+				mu.Unlock()
+			})
+			close(done)
+		}()
+		for seq := 0; seq < perKey; seq++ {
+			if size, ok := c.resizes[seq]; ok {
+				p.Resize(size)
+			}
+			for key := 0; key < keys; key++ {
+				msgs <- amqp.Delivery{CorrelationId: "user-" + strconv.Itoa(key), Body: []byte(strconv.Itoa(seq))}
+			}
+		}
+		close(msgs)
+		<-done
+		for key, seqs := range handled {
+			if len(seqs) != perKey {
+				t.Errorf("size %d resizes %v: %s handled %d deliveries, want %d", c.size, c.resizes, key, len(seqs), perKey)
+			}
+			for i, seq := range seqs {
+				if seq != i {
+					t.Errorf("size %d resizes %v: %s handled %d as number %d", c.size, c.resizes, key, seq, i)
+					break
+				}
+			}
+		}
+		if p.Busy() != 0 {
+			t.Errorf("size %d: %d handlers busy after Run returned", c.size, p.Busy())
+		}
+	}
+}
@@ -14,10 +14,10 @@ func GetAckNack(ch *amqp.Channel) (chan uint64, chan uint64) {
 	return ch.NotifyConfirm(make(chan uint64, 1), make(chan uint64, 1))
 }
 
-func Exchange(exchange string, ch *amqp.Channel) error {
+func ExchangeOfKind(exchange string, kind string, ch *amqp.Channel) error {
 	return ch.ExchangeDeclare(
 		exchange, // name
-		"fanout", // type
+		kind,     // type
 		true,     // durable
 		false,    // auto-deleted
 		false,    // internal
@@ -26,15 +26,16 @@ func Exchange(exchange string, ch *amqp.Channel) error {
 	)
 }
 
-func PublishJson(content []byte, exchange string, ch *amqp.Channel) error {
+func PublishJsonCorrelated(content []byte, exchange string, key string, correlationID string, ch *amqp.Channel) error {
 	return ch.Publish(
 		exchange, // exchange
-		"",       // routing key
+		key,      // routing key
 		false,    // mandatory
 		false,    // immediate
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        content,
+			ContentType:   "application/json",
+			CorrelationId: correlationID,
+			Body:          content,
 		})
 }
 
@@ -50,23 +51,34 @@ func Queue(name string, ch *amqp.Channel) (*amqp.Queue, error) {
 	return &q, err
 }
 
-func QueueBind(q *amqp.Queue, exchange string, ch *amqp.Channel) error {
+func QueueBindKey(q *amqp.Queue, key string, exchange string, ch *amqp.Channel) error {
 	return ch.QueueBind(
 		q.Name,   // queue name
-		"",       // routing key
+		key,      // routing key
 		exchange, // exchange
 		false,
 		nil)
 }
 
-func Consume(q *amqp.Queue, ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+// Qos caps the unacked deliveries of the whole channel at prefetch. Unlike a
+// per-consumer prefetch, RabbitMQ applies a channel's cap to the consumers it
+// already has, so calling it again resizes a running consumer.
+func Qos(prefetch int, ch *amqp.Channel) error {
+	return ch.Qos(
+		prefetch, // prefetch count
+		0,        // prefetch size
+		true,     // global
+	)
+}
+
+func Consume(q *amqp.Queue, consumer string, ch *amqp.Channel) (<-chan amqp.Delivery, error) {
 	return ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
+		q.Name,   // queue
+		consumer, // consumer
+		false,    // auto-ack
+		false,    // exclusive
+		false,    // no-local
+		false,    // no-wait
+		nil,      // args
 	)
 }
@@ -0,0 +1,173 @@
+package redisclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	STANDALONE = "standalone"
+	SENTINEL   = "sentinel"
+	CLUSTER    = "cluster"
+)
+
+// Commands is the subset of redis commands shared by clients, cluster
+// clients and their pipelines.
+type Commands interface {
+	Process(cmd redis.Cmder)
+	Ping() *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+	ExpireAt(key string, tm time.Time) *redis.BoolCmd
+	Rename(key, newkey string) *redis.StatusCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	SScan(key string, cursor int64, match string, count int64) *redis.ScanCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	IncrBy(key string, value int64) *redis.IntCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HMSet(key, field, value string, pairs ...string) *redis.StatusCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZIncrBy(key string, increment float64, member string) *redis.FloatCmd
+	ZRangeByScore(key string, opt redis.ZRangeByScore) *redis.StringSliceCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZRevRank(key, member string) *redis.IntCmd
+	ZScore(key, member string) *redis.FloatCmd
+	PFAdd(key string, fields ...string) *redis.IntCmd
+	PFCount(key string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+}
+
+// Client is a pooled connection to a standalone node, a Sentinel managed
+// master or a Redis Cluster. It is safe for concurrent use and meant to be
+// shared by the whole process.
+type Client interface {
+	Commands
+	Mode() string
+	Pipelined(fn func(pipe Commands) error) error
+	Close() error
+}
+
+type pipeline interface {
+	Commands
+	Exec() ([]redis.Cmder, error)
+	Close() error
+}
+
+type client struct {
+	*redis.Client
+	mode string
+}
+
+func (c *client) Mode() string {
+	return c.mode
+}
+
+func (c *client) Pipelined(fn func(pipe Commands) error) error {
+	return pipelined(c.Client.Pipeline(), fn)
+}
+
+type clusterClient struct {
+	*redis.ClusterClient
+}
+
+func (c *clusterClient) Mode() string {
+	return CLUSTER
+}
+
+func (c *clusterClient) Pipelined(fn func(pipe Commands) error) error {
+	return pipelined(c.ClusterClient.Pipeline(), fn)
+}
+
+func pipelined(pipe pipeline, fn func(pipe Commands) error) error {
+	defer pipe.Close()
+	if err := fn(pipe); err != nil {
+		return err
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// Options is where New reads its settings from, usually a *config.Config.
+type Options interface {
+	String(section string, option string) (string, error)
+	Int(section string, option string) (int, error)
+}
+
+// New builds a client from the section of conf:
+//
+//	redis-mode: standalone | sentinel | cluster (default standalone)
+//	redis-url: host:port of the standalone node
+//	redis-sentinel-master: name of the master monitored by Sentinel
+//	redis-sentinel-addrs: comma separated host:port of the sentinels
+//	redis-cluster-addrs: comma separated host:port of cluster seed nodes
+//	redis-password, redis-db, redis-pool-size: optional
+func New(conf Options, section string) (Client, error) {
+	mode, _ := conf.String(section, "redis-mode")
+	password, _ := conf.String(section, "redis-password")
+	db, _ := conf.Int(section, "redis-db")
+	poolSize, _ := conf.Int(section, "redis-pool-size")
+
+	switch mode {
+	case "", STANDALONE:
+		addr, err := conf.String(section, "redis-url")
+		if err != nil {
+			return nil, err
+		}
+		return &client{redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       int64(db),
+			PoolSize: poolSize,
+		}), STANDALONE}, nil
+	case SENTINEL:
+		master, err := conf.String(section, "redis-sentinel-master")
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := addrList(conf, section, "redis-sentinel-addrs")
+		if err != nil {
+			return nil, err
+		}
+		return &client{redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    master,
+			SentinelAddrs: addrs,
+			Password:      password,
+			DB:            int64(db),
+			PoolSize:      poolSize,
+		}), SENTINEL}, nil
+	case CLUSTER:
+		addrs, err := addrList(conf, section, "redis-cluster-addrs")
+		if err != nil {
+			return nil, err
+		}
+		return &clusterClient{redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: password,
+			PoolSize: poolSize,
+		})}, nil
+	}
+	return nil, fmt.Errorf("unknown redis-mode %q", mode)
+}
+
+func addrList(conf Options, section string, option string) ([]string, error) {
+	value, err := conf.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s lists no addresses", option)
+	}
+	return addrs, nil
+}
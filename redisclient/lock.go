@@ -0,0 +1,72 @@
+package redisclient
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// The WATCH based lock this replaces was released by setting it to "0", so
+// "0" counts as free.
+const (
+	acquireScript = `
+local value = redis.call("GET", KEYS[1])
+if value == false or value == "0" then
+	return redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+return false`
+
+	extendScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+	releaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+)
+
+// Lock is a single key mutex that expires after TTL so a crashed holder
+// cannot keep it forever. Being a single key it works the same in cluster
+// mode.
+type Lock struct {
+	Key   string
+	TTL   time.Duration
+	token string
+}
+
+func NewLock(key string, ttl time.Duration) *Lock {
+	host, _ := os.Hostname()
+	return &Lock{
+		Key:   key,
+		TTL:   ttl,
+		token: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// Acquire reports whether the lock was taken by this caller.
+func (l *Lock) Acquire(c Commands) (bool, error) {
+	ttl := fmt.Sprint(int64(l.TTL / time.Millisecond))
+	err := c.Eval(acquireScript, []string{l.Key}, []string{l.token, ttl}).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Extend resets the expiry of a lock this caller holds and reports whether
+// it still held it.
+func (l *Lock) Extend(c Commands) (bool, error) {
+	ttl := fmt.Sprint(int64(l.TTL / time.Millisecond))
+	held, err := c.Eval(extendScript, []string{l.Key}, []string{l.token, ttl}).Result()
+	return held == int64(1), err
+}
+
+func (l *Lock) Release(c Commands) error {
+	return c.Eval(releaseScript, []string{l.Key}, []string{l.token}).Err()
+}
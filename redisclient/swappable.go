@@ -0,0 +1,206 @@
+package redisclient
+
+import (
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// ConnectionOptions are the options New reads, which Redial dials again with.
+var ConnectionOptions = []string{
+	"redis-mode", "redis-url", "redis-password", "redis-db", "redis-pool-size",
+	"redis-sentinel-master", "redis-sentinel-addrs", "redis-cluster-addrs",
+}
+
+// Swappable is a Client whose connection Redial replaces, for instance when a
+// rotated password is reloaded. Swapping waits for the commands in flight on
+// the old connection and then closes it.
+type Swappable struct {
+	mu     sync.RWMutex
+	client Client
+}
+
+func NewSwappable(client Client) *Swappable {
+	return &Swappable{client: client}
+}
+
+// Redial makes a client from the section of conf and swaps it in once it
+// answers a PING, keeping the current one otherwise.
+func (s *Swappable) Redial(conf Options, section string) error {
+	next, err := New(conf, section)
+	if err != nil {
+		return err
+	}
+	if err := next.Ping().Err(); err != nil {
+		next.Close()
+		return err
+	}
+	s.mu.Lock()
+	previous := s.client
+	s.client = next
+	s.mu.Unlock()
+	return previous.Close()
+}
+
+func (s *Swappable) Mode() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Mode()
+}
+
+func (s *Swappable) Pipelined(fn func(pipe Commands) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Pipelined(fn)
+}
+
+func (s *Swappable) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client.Close()
+}
+
+func (s *Swappable) Process(cmd redis.Cmder) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.client.Process(cmd)
+}
+
+func (s *Swappable) Ping() *redis.StatusCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Ping()
+}
+
+func (s *Swappable) Del(keys ...string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Del(keys...)
+}
+
+func (s *Swappable) ExpireAt(key string, tm time.Time) *redis.BoolCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ExpireAt(key, tm)
+}
+
+func (s *Swappable) Rename(key, newkey string) *redis.StatusCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Rename(key, newkey)
+}
+
+func (s *Swappable) Scan(cursor int64, match string, count int64) *redis.ScanCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Scan(cursor, match, count)
+}
+
+func (s *Swappable) SScan(key string, cursor int64, match string, count int64) *redis.ScanCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.SScan(key, cursor, match, count)
+}
+
+func (s *Swappable) Get(key string) *redis.StringCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Get(key)
+}
+
+func (s *Swappable) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Set(key, value, expiration)
+}
+
+func (s *Swappable) IncrBy(key string, value int64) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.IncrBy(key, value)
+}
+
+func (s *Swappable) HGetAllMap(key string) *redis.StringStringMapCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.HGetAllMap(key)
+}
+
+func (s *Swappable) HMSet(key, field, value string, pairs ...string) *redis.StatusCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.HMSet(key, field, value, pairs...)
+}
+
+func (s *Swappable) SAdd(key string, members ...string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.SAdd(key, members...)
+}
+
+func (s *Swappable) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZAdd(key, members...)
+}
+
+func (s *Swappable) ZIncrBy(key string, increment float64, member string) *redis.FloatCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZIncrBy(key, increment, member)
+}
+
+func (s *Swappable) ZRangeByScore(key string, opt redis.ZRangeByScore) *redis.StringSliceCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZRangeByScore(key, opt)
+}
+
+func (s *Swappable) ZRem(key string, members ...string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZRem(key, members...)
+}
+
+func (s *Swappable) ZRemRangeByScore(key, min, max string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZRemRangeByScore(key, min, max)
+}
+
+func (s *Swappable) ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZRevRangeWithScores(key, start, stop)
+}
+
+func (s *Swappable) ZRevRank(key, member string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZRevRank(key, member)
+}
+
+func (s *Swappable) ZScore(key, member string) *redis.FloatCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.ZScore(key, member)
+}
+
+func (s *Swappable) PFAdd(key string, fields ...string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.PFAdd(key, fields...)
+}
+
+func (s *Swappable) PFCount(key string) *redis.IntCmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.PFCount(key)
+}
+
+func (s *Swappable) Eval(script string, keys []string, args []string) *redis.Cmd {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client.Eval(script, keys, args)
+}
@@ -0,0 +1,52 @@
+package redisclient
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+type options map[string]string
+
+func (o options) String(section string, option string) (string, error) {
+	if value, ok := o[option]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("option %s not found", option)
+}
+
+func (o options) Int(section string, option string) (int, error) {
+	return 0, fmt.Errorf("option %s not found", option)
+}
+
+// Needs a Redis at REDIS_URL (host:port).
+func TestSwappableRedial(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	conf := options{"redis-url": url}
+	client, err := New(conf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSwappable(client)
+	defer s.Close()
+
+	if err := s.Redial(options{"redis-url": "127.0.0.1:1"}, ""); err == nil {
+		t.Fatal("redialed a Redis that does not answer")
+	}
+	if err := s.Ping().Err(); err != nil {
+		t.Fatalf("the failed redial dropped the current connection: %v", err)
+	}
+
+	if err := s.Redial(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping().Err(); err == nil {
+		t.Error("the previous connection is still open")
+	}
+	if err := s.Ping().Err(); err != nil {
+		t.Errorf("the new connection does not answer: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package reporting
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/logger"
+	"labix.org/v2/mgo"
+)
+
+const (
+	JSON = "json"
+	CSV  = "csv"
+
+	DATE_LAYOUT = "2006-01-02"
+	// DEFAULT_RANGE is reported when from is not given.
+	DEFAULT_RANGE = 7 * 24 * time.Hour
+)
+
+var reports = map[string]func(*mgo.Collection, Query) (*Report, error){
+	"totals":         Totals,
+	"users":          Users,
+	"distinct-users": DistinctUsers,
+	"compare":        Compare,
+}
+
+// Handler serves GET <prefix><report>?from=2015-01-01&to=2015-02-01&metric=byte_call&interval=day&format=csv
+// for the totals, users, distinct-users and compare reports. to is exclusive
+// and defaults to now.
+// A report answers 503 while Session cannot reach MongoDB. With Rollups the
+// Collection is the log aggregator's rollups, which are complete even when
+// raw logs are not captured.
+type Handler struct {
+	Prefix     string
+	Session    func() (*mgo.Session, error)
+	DB         string
+	Collection string
+	Rollups    bool
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	run, ok := reports[strings.TrimPrefix(r.URL.Path, h.Prefix)]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q, format, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Rollups = h.Rollups
+
+	connected, err := h.Session()
+	if err != nil {
+		logger.Errorf("Failed to connect to mongodb. ERR: %s", config.Redact(err.Error()))
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	session := connected.Copy()
+	defer session.Close()
+	report, err := run(session.DB(h.DB).C(h.Collection), q)
+	if err != nil {
+		logger.Errorf("Failed to run report %s. ERR: %+v", r.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == CSV {
+		w.Header().Set("Content-Type", "text/csv")
+		err = WriteCSV(w, report)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = WriteJSON(w, report)
+	}
+	if err != nil {
+		logger.Errorf("Failed to write report %s. ERR: %+v", r.URL.Path, err)
+	}
+}
+
+func parseQuery(r *http.Request) (Query, string, error) {
+	values := r.URL.Query()
+	q := Query{
+		To:       time.Now().UTC(),
+		Metric:   values.Get("metric"),
+		Interval: values.Get("interval"),
+	}
+	var err error
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(DATE_LAYOUT, to); err != nil {
+			return q, "", fmt.Errorf("to must be formatted %s", DATE_LAYOUT)
+		}
+	}
+	q.From = q.To.Add(-DEFAULT_RANGE)
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(DATE_LAYOUT, from); err != nil {
+			return q, "", fmt.Errorf("from must be formatted %s", DATE_LAYOUT)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, "", fmt.Errorf("from must be before to")
+	}
+	switch q.Interval {
+	case "":
+		q.Interval = DAY
+	case HOUR, DAY:
+	default:
+		return q, "", fmt.Errorf("interval must be %s or %s", HOUR, DAY)
+	}
+	format := values.Get("format")
+	switch format {
+	case "":
+		format = JSON
+	case JSON, CSV:
+	default:
+		return q, "", fmt.Errorf("format must be %s or %s", JSON, CSV)
+	}
+	return q, format, nil
+}
+
+// WriteJSON renders the report as an array of objects keyed by column.
+func WriteJSON(w io.Writer, report *Report) error {
+	rows := make([]map[string]interface{}, len(report.Rows))
+	for i, row := range report.Rows {
+		rows[i] = map[string]interface{}{}
+		for j, column := range report.Columns {
+			rows[i][column] = row[j]
+		}
+	}
+	return json.NewEncoder(w).Encode(rows)
+}
+
+// WriteCSV renders the report with a header row.
+func WriteCSV(w io.Writer, report *Report) error {
+	writer := csv.NewWriter(w)
+	writer.Write(report.Columns)
+	for _, row := range report.Rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = fmt.Sprint(value)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
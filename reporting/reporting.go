@@ -0,0 +1,240 @@
+package reporting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	HOUR = "hour"
+	DAY  = "day"
+)
+
+// Query selects the logs a report covers: hours in [From, To) and, when set,
+// a single metric. With Rollups the collection holds the log aggregator's
+// hourly rollups rather than raw logs.
+type Query struct {
+	From     time.Time
+	To       time.Time
+	Metric   string
+	Interval string
+	Rollups  bool
+}
+
+// fields are where a document keeps what the reports read. A raw log is one
+// event, a rollup counts its events.
+type fields struct {
+	metric, username, count string
+	events                  interface{}
+}
+
+var (
+	rawFields    = fields{metric: "metrics.metric", username: "metrics.username", count: "metrics.count", events: 1}
+	rollupFields = fields{metric: "metric", username: "username", count: "count", events: "$events"}
+)
+
+func (q Query) fields() fields {
+	if q.Rollups {
+		return rollupFields
+	}
+	return rawFields
+}
+
+// Report is a table of results, rendered as JSON objects or CSV rows.
+type Report struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+func (q Query) match() bson.M {
+	match := bson.M{"hour": bson.M{"$gte": q.From, "$lt": q.To}}
+	if q.Metric != "" {
+		match[q.fields().metric] = q.Metric
+	}
+	return bson.M{"$match": match}
+}
+
+// Totals sums counts and events of each metric per hour or day.
+func Totals(c *mgo.Collection, q Query) (*Report, error) {
+	period := bson.M{
+		"year":  bson.M{"$year": "$hour"},
+		"month": bson.M{"$month": "$hour"},
+		"day":   bson.M{"$dayOfMonth": "$hour"},
+	}
+	if q.Interval == HOUR {
+		period["hour"] = bson.M{"$hour": "$hour"}
+	}
+	f := q.fields()
+	period["metric"] = "$" + f.metric
+
+	var results []struct {
+		ID struct {
+			Year   int    `bson:"year"`
+			Month  int    `bson:"month"`
+			Day    int    `bson:"day"`
+			Hour   int    `bson:"hour"`
+			Metric string `bson:"metric"`
+		} `bson:"_id"`
+		Count  int64 `bson:"count"`
+		Events int64 `bson:"events"`
+	}
+	err := c.Pipe([]bson.M{
+		q.match(),
+		{"$group": bson.M{
+			"_id":    period,
+			"count":  bson.M{"$sum": "$" + f.count},
+			"events": bson.M{"$sum": f.events},
+		}},
+		{"$sort": sortOn("_id.year", "_id.month", "_id.day", "_id.hour", "_id.metric")},
+	}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Columns: []string{"period", "metric", "count", "events"}}
+	for _, r := range results {
+		at := time.Date(r.ID.Year, time.Month(r.ID.Month), r.ID.Day, r.ID.Hour, 0, 0, 0, time.UTC)
+		report.Rows = append(report.Rows, []interface{}{formatPeriod(at, q.Interval), r.ID.Metric, r.Count, r.Events})
+	}
+	return report, nil
+}
+
+// Users breaks the totals down by username and metric.
+func Users(c *mgo.Collection, q Query) (*Report, error) {
+	var results []struct {
+		ID struct {
+			Username string `bson:"username"`
+			Metric   string `bson:"metric"`
+		} `bson:"_id"`
+		Count  int64 `bson:"count"`
+		Events int64 `bson:"events"`
+	}
+	f := q.fields()
+	err := c.Pipe([]bson.M{
+		q.match(),
+		{"$group": bson.M{
+			"_id":    bson.M{"username": "$" + f.username, "metric": "$" + f.metric},
+			"count":  bson.M{"$sum": "$" + f.count},
+			"events": bson.M{"$sum": f.events},
+		}},
+		{"$sort": sortOn("-count", "_id.username", "_id.metric")},
+	}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Columns: []string{"username", "metric", "count", "events"}}
+	for _, r := range results {
+		report.Rows = append(report.Rows, []interface{}{r.ID.Username, r.ID.Metric, r.Count, r.Events})
+	}
+	return report, nil
+}
+
+// DistinctUsers counts the users who sent each metric.
+func DistinctUsers(c *mgo.Collection, q Query) (*Report, error) {
+	var results []struct {
+		Metric string `bson:"_id"`
+		Users  int64  `bson:"users"`
+	}
+	f := q.fields()
+	err := c.Pipe([]bson.M{
+		q.match(),
+		{"$group": bson.M{"_id": bson.M{"metric": "$" + f.metric, "username": "$" + f.username}}},
+		{"$group": bson.M{"_id": "$_id.metric", "users": bson.M{"$sum": 1}}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Columns: []string{"metric", "users"}}
+	for _, r := range results {
+		report.Rows = append(report.Rows, []interface{}{r.Metric, r.Users})
+	}
+	return report, nil
+}
+
+// Compare puts each metric's total over the query next to its total over the
+// period of the same length right before it.
+func Compare(c *mgo.Collection, q Query) (*Report, error) {
+	previous := q
+	previous.To = q.From
+	previous.From = q.From.Add(-q.To.Sub(q.From))
+
+	current, err := metricTotals(c, q)
+	if err != nil {
+		return nil, err
+	}
+	before, err := metricTotals(c, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []string
+	seen := map[string]bool{}
+	for _, totals := range []map[string]int64{current, before} {
+		for metric := range totals {
+			if !seen[metric] {
+				seen[metric] = true
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	sort.Strings(metrics)
+
+	report := &Report{Columns: []string{"metric", "current", "previous", "change", "change_percent"}}
+	for _, metric := range metrics {
+		change := current[metric] - before[metric]
+		percent := ""
+		if before[metric] != 0 {
+			percent = fmt.Sprintf("%.2f", float64(change)*100/float64(before[metric]))
+		}
+		report.Rows = append(report.Rows, []interface{}{metric, current[metric], before[metric], change, percent})
+	}
+	return report, nil
+}
+
+func metricTotals(c *mgo.Collection, q Query) (map[string]int64, error) {
+	var results []struct {
+		Metric string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	f := q.fields()
+	err := c.Pipe([]bson.M{
+		q.match(),
+		{"$group": bson.M{"_id": "$" + f.metric, "count": bson.M{"$sum": "$" + f.count}}},
+	}).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	totals := map[string]int64{}
+	for _, r := range results {
+		totals[r.Metric] = r.Count
+	}
+	return totals, nil
+}
+
+func formatPeriod(t time.Time, interval string) string {
+	if interval == HOUR {
+		return t.Format("2006-01-02T15:00Z")
+	}
+	return t.Format("2006-01-02")
+}
+
+// sortOn builds an ordered $sort document; a leading "-" sorts descending.
+func sortOn(fields ...string) bson.D {
+	doc := make(bson.D, len(fields))
+	for i, field := range fields {
+		order := 1
+		if strings.HasPrefix(field, "-") {
+			field, order = field[1:], -1
+		}
+		doc[i] = bson.DocElem{Name: field, Value: order}
+	}
+	return doc
+}
@@ -0,0 +1,29 @@
+package reporting
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMatch(t *testing.T) {
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	hours := bson.M{"$gte": from, "$lt": to}
+	cases := []struct {
+		q    Query
+		want bson.M
+	}{
+		{Query{From: from, To: to}, bson.M{"hour": hours}},
+		{Query{From: from, To: to, Metric: "byte_call"}, bson.M{"hour": hours, "metrics.metric": "byte_call"}},
+		{Query{From: from, To: to, Rollups: true}, bson.M{"hour": hours}},
+		{Query{From: from, To: to, Metric: "byte_call", Rollups: true}, bson.M{"hour": hours, "metric": "byte_call"}},
+	}
+	for _, c := range cases {
+		if got := c.q.match(); !reflect.DeepEqual(got, bson.M{"$match": c.want}) {
+			t.Errorf("match of %+v = %v, want %v", c.q, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next activation time strictly after the given time.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+type bounds struct {
+	min, max int
+}
+
+var (
+	minutes = bounds{0, 59}
+	hours   = bounds{0, 23}
+	dom     = bounds{1, 31}
+	months  = bounds{1, 12}
+	dow     = bounds{0, 6}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// CronSchedule is a standard five field cron expression
+// (minute hour day-of-month month day-of-week) evaluated in UTC.
+type CronSchedule struct {
+	Minute, Hour, Dom, Month, Dow uint64
+	domStar, dowStar              bool
+}
+
+// Parse parses a five field cron expression or one of the @yearly, @monthly,
+// @weekly, @daily and @hourly descriptors.
+func Parse(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := descriptors[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron spec %q, found %d", spec, len(fields))
+	}
+
+	var err error
+	s := &CronSchedule{
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+	}
+	if s.Minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, err
+	}
+	if s.Hour, err = parseField(fields[1], hours); err != nil {
+		return nil, err
+	}
+	if s.Dom, err = parseField(fields[2], dom); err != nil {
+		return nil, err
+	}
+	if s.Month, err = parseField(fields[3], months); err != nil {
+		return nil, err
+	}
+	if s.Dow, err = parseField(fields[4], dow); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		r, err := parseRange(part, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= r
+	}
+	return bits, nil
+}
+
+func parseRange(expr string, b bounds) (uint64, error) {
+	var (
+		start, end, step int
+		err              error
+	)
+	rangeAndStep := strings.SplitN(expr, "/", 2)
+	lowAndHigh := strings.SplitN(rangeAndStep[0], "-", 2)
+
+	if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
+		start, end = b.min, b.max
+	} else {
+		if start, err = strconv.Atoi(lowAndHigh[0]); err != nil {
+			return 0, fmt.Errorf("invalid value %q in cron spec", expr)
+		}
+		end = start
+		if len(lowAndHigh) == 2 {
+			if end, err = strconv.Atoi(lowAndHigh[1]); err != nil {
+				return 0, fmt.Errorf("invalid value %q in cron spec", expr)
+			}
+		}
+	}
+
+	step = 1
+	if len(rangeAndStep) == 2 {
+		if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+			return 0, fmt.Errorf("invalid step %q in cron spec", expr)
+		}
+		// "5/15" means every 15 starting at 5.
+		if len(lowAndHigh) == 1 && lowAndHigh[0] != "*" && lowAndHigh[0] != "?" {
+			end = b.max
+		}
+	}
+
+	if start < b.min || end > b.max || start > end {
+		return 0, fmt.Errorf("value %q out of range [%d, %d] in cron spec", expr, b.min, b.max)
+	}
+
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+// Next returns the first activation time after t, truncated to the minute.
+// A zero time is returned if no activation exists within five years.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.Month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.Hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.Minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows cron semantics: when both day fields are restricted
+// a day matching either of them is accepted.
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.Dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.Dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
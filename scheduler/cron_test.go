@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"@fortnightly",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(value string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04:05", value)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	cases := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"* * * * *", "2016-03-01 10:15:30", "2016-03-01 10:16:00"},
+		{"* * * * *", "2016-03-01 10:15:00", "2016-03-01 10:16:00"},
+		{"30 * * * *", "2016-03-01 10:30:00", "2016-03-01 11:30:00"},
+		{"*/15 * * * *", "2016-03-01 10:16:00", "2016-03-01 10:30:00"},
+		{"5/15 * * * *", "2016-03-01 10:51:00", "2016-03-01 11:05:00"},
+		{"0 9-17/4 * * *", "2016-03-01 13:00:00", "2016-03-01 17:00:00"},
+		{"0 0,12 * * *", "2016-03-01 01:00:00", "2016-03-01 12:00:00"},
+		{"@hourly", "2016-03-01 10:15:00", "2016-03-01 11:00:00"},
+		{"@daily", "2016-12-31 10:15:00", "2017-01-01 00:00:00"},
+		{"@weekly", "2016-03-01 10:15:00", "2016-03-06 00:00:00"},
+		{"@monthly", "2016-01-31 00:00:00", "2016-02-01 00:00:00"},
+		{"@yearly", "2016-03-01 10:15:00", "2017-01-01 00:00:00"},
+		{"0 0 29 2 *", "2016-03-01 00:00:00", "2020-02-29 00:00:00"},
+		{"0 0 31 * *", "2016-04-01 00:00:00", "2016-05-31 00:00:00"},
+		// With both day fields restricted either one matches.
+		{"0 0 15 * 1", "2016-03-01 00:00:00", "2016-03-07 00:00:00"},
+		{"0 0 1 * 1", "2016-03-08 00:00:00", "2016-03-14 00:00:00"},
+		{"0 0 ? * 1", "2016-03-08 00:00:00", "2016-03-14 00:00:00"},
+		{"0 0 30 2 *", "2016-01-01 00:00:00", "0001-01-01 00:00:00"},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.spec, err)
+			continue
+		}
+		if got := s.Next(at(c.from)); !got.Equal(at(c.want)) {
+			t.Errorf("Next of %q after %s = %s, want %s", c.spec, c.from, got, c.want)
+		}
+	}
+}
+
+func TestNextIsUTC(t *testing.T) {
+	s, _ := Parse("0 12 * * *")
+	from := time.Date(2016, 3, 1, 11, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	if got, want := s.Next(from), time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next after %s = %s, want %s", from, got, want)
+	}
+}
@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/logger"
+)
+
+// RETRY_DELAY is how long an activation that failed all its attempts waits
+// before it is run again.
+const RETRY_DELAY = 10 * time.Minute
+
+// RetryPolicy retries a failed run up to Attempts times, doubling Backoff
+// after every failure.
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// Job is run at every activation of its Schedule. Run receives the scheduled
+// time rather than the wall clock so that caught-up runs process the period
+// they were meant for.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Retry    RetryPolicy
+	Run      func(scheduled time.Time) error
+}
+
+type Scheduler struct {
+	mu    sync.Mutex
+	store Store
+	jobs  []*Job
+	stop  chan bool
+}
+
+func New(store Store) *Scheduler {
+	return &Scheduler{store: store, stop: make(chan bool)}
+}
+
+func (s *Scheduler) Add(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+}
+
+// SetRetry changes the retry policy of the named job from its next run on.
+func (s *Scheduler) SetRetry(name string, policy RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.Name == name {
+			job.Retry = policy
+		}
+	}
+}
+
+func (s *Scheduler) retry(job *Job) RetryPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return job.Retry
+}
+
+// Start runs every job in its own goroutine. Activations missed while no
+// scheduler was running are executed in order before waiting for the next.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		go s.loop(job)
+	}
+}
+
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) loop(job *Job) {
+	for {
+		next, err := s.nextRun(job)
+		if err != nil {
+			logger.Errorf("Failed to load state of job %s. ERR: %+v", job.Name, err)
+			if !s.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		if next.IsZero() {
+			logger.Infof("Job %s has no upcoming activation", job.Name)
+			return
+		}
+		if !s.sleep(next.Sub(time.Now())) {
+			return
+		}
+
+		// Another replica sharing the store may have run this activation
+		// while we were waiting.
+		state, err := s.store.Load(job.Name)
+		if err != nil {
+			logger.Errorf("Failed to load state of job %s. ERR: %+v", job.Name, err)
+			continue
+		}
+		if state.NextRun.After(next) {
+			continue
+		}
+
+		attempts, err := s.run(job, next)
+		if err != nil {
+			// A replica that ran it meanwhile has moved the job on.
+			if latest, lerr := s.store.Load(job.Name); lerr == nil && latest.NextRun.After(next) {
+				continue
+			}
+		}
+		state.LastRun = next
+		state.NextRun = job.Schedule.Next(next)
+		state.Attempts = attempts
+		state.Outcome, state.Error = SUCCEEDED, ""
+		if err != nil {
+			// The activation stays due, so it is caught up like a missed one.
+			state.NextRun = next
+			state.Outcome, state.Error = FAILED, err.Error()
+		}
+		if err := s.store.Save(job.Name, state); err != nil {
+			logger.Errorf("Failed to save state of job %s. ERR: %+v", job.Name, err)
+		}
+		if err != nil && !s.sleep(RETRY_DELAY) {
+			return
+		}
+	}
+}
+
+func (s *Scheduler) nextRun(job *Job) (time.Time, error) {
+	state, err := s.store.Load(job.Name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !state.NextRun.IsZero() {
+		return state.NextRun, nil
+	}
+	state.NextRun = job.Schedule.Next(time.Now())
+	return state.NextRun, s.store.Save(job.Name, state)
+}
+
+func (s *Scheduler) run(job *Job, scheduled time.Time) (attempts int, err error) {
+	policy := s.retry(job)
+	backoff := policy.Backoff
+	for attempts = 1; ; attempts++ {
+		logger.Infof("Running job %s for %s (attempt %d)", job.Name, scheduled, attempts)
+		err = safeRun(job, scheduled)
+		if err == nil || attempts > policy.Attempts {
+			return
+		}
+		logger.Errorf("Job %s failed. ERR: %+v", job.Name, err)
+		logger.Warnf("Backing off for %s", backoff)
+		if !s.sleep(backoff) {
+			return
+		}
+		backoff = backoff * 2
+	}
+}
+
+func safeRun(job *Job, scheduled time.Time) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(scheduled)
+}
+
+// sleep waits for d and reports false if the scheduler was stopped meanwhile.
+func (s *Scheduler) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.stop:
+		return false
+	}
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps the states in a map.
+type memoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{states: map[string]State{}}
+}
+
+func (s *memoryStore) Load(name string) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.states[name]
+	return &state, nil
+}
+
+func (s *memoryStore) Save(name string, state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[name] = *state
+	return nil
+}
+
+// runs records the scheduled times a job ran for.
+type runs struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (r *runs) add(scheduled time.Time) {
+	r.mu.Lock()
+	r.times = append(r.times, scheduled)
+	r.mu.Unlock()
+}
+
+// wait returns the first n runs, failing the test if they take longer than a
+// second.
+func (r *runs) wait(t *testing.T, n int) []time.Time {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		if len(r.times) >= n {
+			times := append([]time.Time{}, r.times[:n]...)
+			r.mu.Unlock()
+			return times
+		}
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.Fatalf("%d runs within a second, want %d", len(r.times), n)
+	return nil
+}
+
+// Missed activations run in order, each for its own scheduled time, before
+// the job waits for the next one.
+func TestCatchUp(t *testing.T) {
+	everyMinute, _ := Parse("* * * * *")
+	cases := []struct {
+		missed int
+	}{
+		{0},
+		{1},
+		{5},
+	}
+	for _, c := range cases {
+		now := time.Now().UTC().Truncate(time.Minute)
+		store := newMemoryStore()
+		first := now.Add(-time.Duration(c.missed) * time.Minute)
+		store.Save("job", &State{NextRun: first})
+
+		var ran runs
+		s := New(store)
+		s.Add(&Job{Name: "job", Schedule: everyMinute, Run: func(scheduled time.Time) error {
+			ran.add(scheduled)
+			return nil
+		}})
+		s.Start()
+		times := ran.wait(t, c.missed+1)
+		s.Stop()
+		for i, scheduled := range times {
+			if want := first.Add(time.Duration(i) * time.Minute); !scheduled.Equal(want) {
+				t.Errorf("%d missed: run %d was for %s, want %s", c.missed, i, scheduled, want)
+			}
+		}
+	}
+}
+
+func TestFailedRunStaysDue(t *testing.T) {
+	everyMinute, _ := Parse("* * * * *")
+	scheduled := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	store := newMemoryStore()
+	store.Save("job", &State{NextRun: scheduled})
+
+	var ran runs
+	s := New(store)
+	s.Add(&Job{Name: "job", Schedule: everyMinute, Retry: RetryPolicy{Attempts: 2, Backoff: time.Millisecond}, Run: func(scheduled time.Time) error {
+		ran.add(scheduled)
+		return errors.New("store is down")
+	}})
+	s.Start()
+	ran.wait(t, 3)
+
+	var state *State
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if state, _ = store.Load("job"); state.Outcome != "" {
+			break
+		}
+	}
+	s.Stop()
+	if state.Outcome != FAILED || state.Attempts != 3 || !state.NextRun.Equal(scheduled) || state.Error != "store is down" {
+		t.Errorf("state %+v, want %s after 3 attempts and still due at %s", state, FAILED, scheduled)
+	}
+	time.Sleep(10 * time.Millisecond)
+	ran.mu.Lock()
+	defer ran.mu.Unlock()
+	if len(ran.times) != 3 {
+		t.Errorf("ran %d times, want 3 before the retry delay", len(ran.times))
+	}
+}
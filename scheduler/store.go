@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"strconv"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+	"labix.org/v2/mgo"
+)
+
+const (
+	SUCCEEDED = "succeeded"
+	FAILED    = "failed"
+
+	STATE_KEY_PREFIX = "scheduler:"
+)
+
+// State is the persisted bookkeeping of a job.
+type State struct {
+	LastRun  time.Time
+	NextRun  time.Time
+	Outcome  string
+	Error    string
+	Attempts int
+}
+
+// Store persists job state so schedules survive restarts.
+type Store interface {
+	Load(name string) (*State, error)
+	Save(name string, state *State) error
+}
+
+// Hashes is satisfied by redis clients of every mode.
+type Hashes interface {
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HMSet(key, field, value string, pairs ...string) *redis.StatusCmd
+}
+
+// RedisStore keeps each job's state in a hash at scheduler:<name>.
+type RedisStore struct {
+	Client Hashes
+}
+
+func NewRedisStore(client Hashes) *RedisStore {
+	return &RedisStore{Client: client}
+}
+
+func (s *RedisStore) Load(name string) (*State, error) {
+	fields, err := s.Client.HGetAllMap(STATE_KEY_PREFIX + name).Result()
+	if err != nil {
+		return nil, err
+	}
+	state := &State{
+		LastRun: parseTime(fields["last-run"]),
+		NextRun: parseTime(fields["next-run"]),
+		Outcome: fields["outcome"],
+		Error:   fields["error"],
+	}
+	if attempts, ok := fields["attempts"]; ok {
+		state.Attempts, _ = strconv.Atoi(attempts)
+	}
+	return state, nil
+}
+
+func (s *RedisStore) Save(name string, state *State) error {
+	return s.Client.HMSet(STATE_KEY_PREFIX+name,
+		"last-run", formatTime(state.LastRun),
+		"next-run", formatTime(state.NextRun),
+		"outcome", state.Outcome,
+		"error", state.Error,
+		"attempts", strconv.Itoa(state.Attempts),
+	).Err()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// MongoStore keeps each job's state in a document whose _id is the job name.
+// When Session is set, each call runs on the session it returns and closes
+// it, so the owner can redial.
+type MongoStore struct {
+	Collection *mgo.Collection
+	Session    func() *mgo.Session
+}
+
+type stateDocument struct {
+	Name  string `bson:"_id"`
+	State `bson:",inline"`
+}
+
+func NewMongoStore(c *mgo.Collection) *MongoStore {
+	return &MongoStore{Collection: c}
+}
+
+func (s *MongoStore) collection() (*mgo.Collection, func()) {
+	if s.Session == nil {
+		return s.Collection, func() {}
+	}
+	session := s.Session()
+	return s.Collection.With(session), session.Close
+}
+
+func (s *MongoStore) Load(name string) (*State, error) {
+	c, done := s.collection()
+	defer done()
+	var doc stateDocument
+	err := c.FindId(name).One(&doc)
+	if err == mgo.ErrNotFound {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc.State, nil
+}
+
+func (s *MongoStore) Save(name string, state *State) error {
+	c, done := s.collection()
+	defer done()
+	_, err := c.UpsertId(name, &stateDocument{Name: name, State: *state})
+	return err
+}
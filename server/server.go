@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arvindram03/asynch-workers/broker"
+	"github.com/arvindram03/asynch-workers/config"
+	"github.com/arvindram03/asynch-workers/data"
+	"github.com/arvindram03/asynch-workers/fault"
+	"github.com/arvindram03/asynch-workers/leaderboard"
+	"github.com/arvindram03/asynch-workers/logger"
+	"github.com/arvindram03/asynch-workers/redisclient"
+	"github.com/arvindram03/asynch-workers/reporting"
+	"labix.org/v2/mgo"
+)
+
+const (
+	POST = "POST"
+	GET  = "GET"
+
+	DEFAULT_TOP_N = 10
+	MAX_TOP_N     = 100
+
+	REQUEST_ID_HEADER = "X-Request-ID"
+	MAX_REQUEST_ID    = 128
+
+	MONGO_DIAL_TIMEOUT = 5 * time.Second
+)
+
+var (
+	Config      *config.Config
+	ENV         string
+	Settings    config.Settings
+	RedisClient *redisclient.Swappable
+	Mongo       *mgo.Session
+	Broker      broker.Broker
+
+	configLock sync.RWMutex
+	storesLock sync.Mutex
+
+	// Required lists the options the server cannot start without.
+	Required = []string{"exchange", "mongo-url", "mongo-db-name", "mongo-collection-name"}
+)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Hello Gophers :)")
+}
+
+func metricHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != POST {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := requestID(r)
+	w.Header().Set(REQUEST_ID_HEADER, id)
+	metric, err := publishMetric(r, id)
+	l := logger.With(logger.MetricFields(metric.Username, metric.Metric, metric.Count)).With(logger.Fields{"request_id": id})
+	if err != nil {
+		l.Errorf("Failed to push metric. ERR: %s", config.Redact(err.Error()))
+		writeError(w, err)
+		return
+	}
+	l.Infof("Pushed metric")
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestID is the client's X-Request-ID, or a new one, which follows the
+// metric to the workers.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(REQUEST_ID_HEADER); id != "" && len(id) <= MAX_REQUEST_ID {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// publishMetric decodes the metric posted in r and publishes it. A body
+// that is no metric is poison; the broker refusing or being unreachable may
+// pass.
+func publishMetric(r *http.Request, requestID string) (data.Metric, error) {
+	var metric data.Metric
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+		return metric, fault.Poison(err)
+	}
+	metricJson, err := json.Marshal(metric)
+	if err != nil {
+		return metric, fault.Permanent(err)
+	}
+	_, settings := currentConfig()
+	err = Broker.Publish(settings.Exchange, metric.RoutingKey(settings.RoutingShards), metricJson, requestID)
+	return metric, fault.Retryable(err)
+}
+
+// writeError answers with the status of err's class, asking the client to
+// retry a retryable failure in a second.
+func writeError(w http.ResponseWriter, err error) {
+	status := fault.Status(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(status)
+}
+
+// leaderboardHandler serves /leaderboard?window=week&metric=byte_call&n=10&user=kodingbot.
+// Without a metric it ranks metrics instead of users.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	window := query.Get("window")
+	if window == "" {
+		window = leaderboard.DAY
+	}
+	if !leaderboard.IsWindow(window) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n := int64(DEFAULT_TOP_N)
+	if value := query.Get("n"); value != "" {
+		var err error
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if n > MAX_TOP_N {
+			n = MAX_TOP_N
+		}
+	}
+
+	now := time.Now().UTC()
+	metric := query.Get("metric")
+	key := leaderboard.Key(window, now, metric)
+	client, err := redisClient()
+	if err != nil {
+		logger.Errorf("Failed to configure redis. ERR: %s", config.Redact(err.Error()))
+		writeError(w, err)
+		return
+	}
+	top, err := leaderboard.Top(client, key, n)
+	if err != nil {
+		logger.Errorf("Failed to read leaderboard. ERR: %+v", err)
+		writeError(w, err)
+		return
+	}
+	response := struct {
+		Window string              `json:"window"`
+		Period string              `json:"period"`
+		Metric string              `json:"metric,omitempty"`
+		Top    []leaderboard.Entry `json:"top"`
+		User   *leaderboard.Entry  `json:"user,omitempty"`
+	}{
+		Window: window,
+		Period: leaderboard.Period(window, now),
+		Metric: metric,
+		Top:    top,
+	}
+	if user := query.Get("user"); user != "" && metric != "" {
+		response.User, err = leaderboard.Rank(client, key, user)
+		if err != nil {
+			logger.Errorf("Failed to read leaderboard rank. ERR: %+v", err)
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// redisClient makes the client on first use. The stores are only needed by
+// the leaderboard and the reports, so the metric ingest runs without them.
+func redisClient() (redisclient.Client, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	if RedisClient == nil {
+		conf, _ := currentConfig()
+		client, err := redisclient.New(conf, conf.Env)
+		if err != nil {
+			return nil, err
+		}
+		RedisClient = redisclient.NewSwappable(client)
+	}
+	return RedisClient, nil
+}
+
+// mongoSession dials MongoDB on first use, and again on the next request
+// after a failed dial.
+func mongoSession() (*mgo.Session, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	if Mongo == nil {
+		_, settings := currentConfig()
+		session, err := mgo.DialWithTimeout(settings.MongoURL, MONGO_DIAL_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		Mongo = session
+	}
+	return Mongo, nil
+}
+
+func closeStores() {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	if RedisClient != nil {
+		RedisClient.Close()
+	}
+	if Mongo != nil {
+		Mongo.Close()
+	}
+}
+
+// redialStores has the stores already in use follow a reload that changed
+// their connection options. The reports copy the session, so the copies
+// running keep the previous one open until they finish.
+func redialStores(next *config.Config, changed []string) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	if RedisClient != nil && len(config.Changed(changed, redisclient.ConnectionOptions...)) > 0 {
+		if err := RedisClient.Redial(next, next.Env); err != nil {
+			logger.Errorf("Failed to redial redis, keeping the current connection. ERR: %s", config.Redact(err.Error()))
+		}
+	}
+	if Mongo != nil && len(config.Changed(changed, "mongo-url")) > 0 {
+		Mongo.Close()
+		Mongo = nil
+	}
+}
+
+func currentConfig() (*config.Config, config.Settings) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Config, Settings
+}
+
+// watchConfig swaps in a reloaded config. The publishing settings are read
+// per request and the stores redial; the rest needs a restart.
+func watchConfig() {
+	reloader := config.NewReloader(Config, append([]string{"rabbitmq-url", "exchange", "mongo-url"}, redisclient.ConnectionOptions...)...)
+	reloader.Validate = func(next *config.Config) error {
+		for _, option := range []string{"rabbitmq-url", "exchange"} {
+			value, err := next.String(next.Env, option)
+			if err == nil && value == "" {
+				err = errors.New("it is empty")
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", option, err)
+			}
+		}
+		return nil
+	}
+	reloader.Apply = func(next *config.Config, changed []string) {
+		configLock.Lock()
+		Config = next
+		Settings = next.Settings()
+		configLock.Unlock()
+		redialStores(next, changed)
+	}
+	reloader.Start(Config)
+}
+
+// RabbitMQURL reads rabbitmq-url from the current config, for a broker that
+// should follow reloads.
+func RabbitMQURL() (string, error) {
+	conf, _ := currentConfig()
+	return conf.String(conf.Env, "rabbitmq-url")
+}
+
+// Run serves the HTTP API on :6055 and publishes metrics to b.
+func Run(conf *config.Config, b broker.Broker) {
+	Broker = b
+	Config = conf
+	ENV = conf.Env
+	Settings = conf.Settings()
+	watchConfig()
+	defer closeStores()
+	http.HandleFunc("/metric", metricHandler)
+	http.HandleFunc("/leaderboard", leaderboardHandler)
+	reports := &reporting.Handler{
+		Prefix:     "/reports/",
+		Session:    mongoSession,
+		DB:         Settings.MongoDBName,
+		Collection: Settings.MongoCollectionName,
+	}
+	// Raw logs may not be captured when the log aggregator rolls them up.
+	if rollup, _ := Config.Bool(ENV, "log-rollup"); rollup {
+		reports.Rollups = true
+		reports.Collection, _ = Config.String(ENV, "mongo-rollup-collection-name")
+	}
+	http.Handle("/reports/", reports)
+	http.HandleFunc("/", handler)
+	logger.Infof("Listening on 6055...")
+	http.ListenAndServe(":6055", nil)
+}